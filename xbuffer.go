@@ -3,6 +3,7 @@ package xtcp
 import (
 	"errors"
 	"io"
+	"sync"
 )
 
 var (
@@ -133,6 +134,34 @@ func NewBuffer(initSize, maxSize int) *Buffer {
 	return b
 }
 
+// bufferPool is the pool of Buffer to reduce allocations, eg: the recv buf of conns.
+var bufferPool sync.Pool
+
+// getBuffer get a Buffer from the pool, create a new one if no suitable Buffer in the pool.
+// It's the same as NewBuffer except the raw buf may be reused.
+func getBuffer(initSize, maxSize int) *Buffer {
+	if initSize == 0 || initSize > maxSize {
+		return nil
+	}
+	if b, ok := bufferPool.Get().(*Buffer); ok {
+		if c := cap(b.buf); c >= initSize && c <= maxSize {
+			b.or = 0
+			b.ow = 0
+			b.maxSize = maxSize
+			return b
+		}
+		// not suitable, let it be collected.
+	}
+	return NewBuffer(initSize, maxSize)
+}
+
+// putBuffer put the Buffer back to the pool, b can't be used after put.
+func putBuffer(b *Buffer) {
+	if b != nil {
+		bufferPool.Put(b)
+	}
+}
+
 // makeSlice allocates a slice of size n. If the allocation fails, it panics
 // with ErrNoMemory.
 func makeSlice(n int) []byte {
@@ -71,3 +71,34 @@ func TestGrow(t *testing.T) {
 		return
 	}
 }
+
+func TestGetBuffer(t *testing.T) {
+	buf := getBuffer(128, 256)
+	buf.Write(make([]byte, 100))
+	putBuffer(buf)
+
+	buf = getBuffer(128, 256)
+	if buf.UnreadLen() != 0 || buf.Cap() < 128 || buf.Cap() > 256 {
+		t.Errorf("empty buf with cap in [128, 256] expected, got len %v cap %v", buf.UnreadLen(), buf.Cap())
+	}
+	if getBuffer(0, 256) != nil {
+		t.Error("nil expected if initSize == 0")
+	}
+}
+
+func BenchmarkNewBuffer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := NewBuffer(DefaultRecvBufInitSize, DefaultRecvBufMaxSize)
+		buf.Write(make([]byte, 64))
+	}
+}
+
+func BenchmarkGetBuffer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer(DefaultRecvBufInitSize, DefaultRecvBufMaxSize)
+		buf.Write(make([]byte, 64))
+		putBuffer(buf)
+	}
+}
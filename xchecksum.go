@@ -0,0 +1,123 @@
+package xtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var (
+	// ErrChecksumMismatch means that the checksum of the frame is not the same as the one calculated from it,
+	// eg: the bytes are corrupted.
+	ErrChecksumMismatch = errors.New("xtcp.protocol: checksum mismatch")
+)
+
+// checksumPrefixLen is the length of the big endian length prefix of the checksummed frames.
+const checksumPrefixLen = 4
+
+// checksumLen is the length of the big endian CRC32 after the payload.
+const checksumLen = 4
+
+// ChecksummedProtocol wrap the Inner protocol and append a CRC32 of the packed bytes.
+// Each packet is packed by Inner into one frame with a 4 bytes big endian length prefix,
+// followed by the 4 bytes big endian CRC32 of the packed bytes calculated by Table.
+// Unpack verify the CRC32 only when the frame is complete and return ErrChecksumMismatch with the frame
+// discarded if not match, EventError is fired by the conn then, Stop it in the Handler to close the conn.
+// The packed bytes must be exactly one Packet of Inner, otherwise ErrInvalidFrame returned.
+type ChecksummedProtocol struct {
+	Inner  Protocol
+	Table  *crc32.Table // eg: crc32.IEEETable or crc32.MakeTable(crc32.Castagnoli).
+	MaxLen int          // max length of the packed bytes of Inner, 0 mean no limit.
+}
+
+// NewChecksummedProtocol create a new ChecksummedProtocol, nil table mean crc32.IEEETable.
+// will panic if inner is nil or maxLen is negative.
+func NewChecksummedProtocol(inner Protocol, table *crc32.Table, maxLen int) *ChecksummedProtocol {
+	if inner == nil {
+		panic("xtcp.NewChecksummedProtocol: nil inner protocol")
+	}
+	if maxLen < 0 {
+		panic("xtcp.NewChecksummedProtocol: negative max length")
+	}
+	if table == nil {
+		table = crc32.IEEETable
+	}
+	return &ChecksummedProtocol{
+		Inner:  inner,
+		Table:  table,
+		MaxLen: maxLen,
+	}
+}
+
+// PackSize return the size need for pack the Packet, 0 if Inner return 0.
+func (cp *ChecksummedProtocol) PackSize(p Packet) int {
+	size := cp.Inner.PackSize(p)
+	if size <= 0 {
+		return 0
+	}
+	return checksumPrefixLen + size + checksumLen
+}
+
+// PackTo pack the Packet by Inner, then write the frame with the checksum to w.
+func (cp *ChecksummedProtocol) PackTo(p Packet, w io.Writer) (int, error) {
+	frame, err := cp.Pack(p)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(frame)
+}
+
+// Pack pack the Packet to new created buf.
+func (cp *ChecksummedProtocol) Pack(p Packet) ([]byte, error) {
+	raw, err := cp.Inner.Pack(p)
+	if err != nil {
+		return nil, err
+	}
+	if (cp.MaxLen > 0 && len(raw) > cp.MaxLen) || uint64(len(raw)) > 1<<32-1-checksumLen {
+		return nil, ErrPacketTooLong
+	}
+
+	frame := make([]byte, checksumPrefixLen+len(raw)+checksumLen)
+	binary.BigEndian.PutUint32(frame, uint32(len(raw)+checksumLen))
+	copy(frame[checksumPrefixLen:], raw)
+	binary.BigEndian.PutUint32(frame[checksumPrefixLen+len(raw):], crc32.Checksum(raw, cp.table()))
+	return frame, nil
+}
+
+// Unpack try to unpack one checksummed frame from buf.
+// return ErrChecksumMismatch if the checksum not match, the frame will be discard.
+func (cp *ChecksummedProtocol) Unpack(buf []byte) (Packet, int, error) {
+	maxLen := 0
+	if cp.MaxLen > 0 {
+		maxLen = cp.MaxLen + checksumLen
+	}
+	payload, n, err := ReadFrame(buf, checksumPrefixLen, binary.BigEndian, maxLen)
+	if err != nil || n == 0 {
+		return nil, n, err
+	}
+	if len(payload) < checksumLen {
+		return nil, n, ErrInvalidFrame
+	}
+
+	raw := payload[:len(payload)-checksumLen]
+	if crc32.Checksum(raw, cp.table()) != binary.BigEndian.Uint32(payload[len(raw):]) {
+		return nil, n, ErrChecksumMismatch
+	}
+
+	p, pl, err := cp.Inner.Unpack(raw)
+	if err != nil {
+		return nil, n, err
+	}
+	if p == nil || pl != len(raw) {
+		return nil, n, ErrInvalidFrame
+	}
+	return p, n, nil
+}
+
+func (cp *ChecksummedProtocol) table() *crc32.Table {
+	if cp.Table == nil {
+		return crc32.IEEETable
+	}
+	return cp.Table
+}
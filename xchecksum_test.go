@@ -0,0 +1,59 @@
+package xtcp
+
+import (
+	"hash/crc32"
+	"testing"
+)
+
+func TestChecksummedProtocol(t *testing.T) {
+	for _, table := range []*crc32.Table{nil, crc32.MakeTable(crc32.Castagnoli)} {
+		cp := NewChecksummedProtocol(&myProtocol{}, table, 64)
+		buf, err := cp.Pack(&myPacket{msg: "hello"})
+		if err != nil {
+			t.Error("pack err : ", err)
+			continue
+		}
+		if size := cp.PackSize(&myPacket{msg: "hello"}); size != len(buf) {
+			t.Errorf("pack size %v expected, got %v", len(buf), size)
+		}
+
+		p, n, err := cp.Unpack(buf[:len(buf)-1])
+		if p != nil || n != 0 || err != nil {
+			t.Errorf("(nil, 0, nil) expected for partial frame, got (%v, %v, %v)", p, n, err)
+		}
+
+		// two frames in buf, only the first one unpacked.
+		p, n, err = cp.Unpack(append(buf, buf...))
+		if err != nil || n != len(buf) || p.String() != "hello" {
+			t.Errorf("(hello, %v, nil) expected, got (%v, %v, %v)", len(buf), p, n, err)
+		}
+
+		// flip one byte of the payload, the frame is discarded.
+		bad := append([]byte(nil), buf...)
+		bad[len(bad)-checksumLen-1] ^= 0x01
+		if p, n, err := cp.Unpack(bad); err != ErrChecksumMismatch || n != len(bad) || p != nil {
+			t.Errorf("(nil, %v, ErrChecksumMismatch) expected, got (%v, %v, %v)", len(bad), p, n, err)
+		}
+
+		small := NewChecksummedProtocol(&myProtocol{}, table, 4)
+		if _, err := small.Pack(&myPacket{msg: "hello"}); err != ErrPacketTooLong {
+			t.Errorf("ErrPacketTooLong expected for pack, got %v", err)
+		}
+		if p, n, err := small.Unpack(buf); err != ErrPacketTooLong || n != len(buf) || p != nil {
+			t.Errorf("(nil, %v, ErrPacketTooLong) expected, got (%v, %v, %v)", len(buf), p, n, err)
+		}
+	}
+
+	// the checksum of another table doesn't match.
+	ieee, _ := NewChecksummedProtocol(&myProtocol{}, nil, 0).Pack(&myPacket{msg: "hello"})
+	castagnoli := NewChecksummedProtocol(&myProtocol{}, crc32.MakeTable(crc32.Castagnoli), 0)
+	if _, _, err := castagnoli.Unpack(ieee); err != ErrChecksumMismatch {
+		t.Errorf("ErrChecksumMismatch expected for another table, got %v", err)
+	}
+
+	// the checksummed bytes is not a complete inner packet.
+	cp := NewChecksummedProtocol(NewDelimiterProtocol('\n', 0), nil, 0)
+	if p, n, err := cp.Unpack(ieee); err != ErrInvalidFrame || n != len(ieee) || p != nil {
+		t.Errorf("(nil, %v, ErrInvalidFrame) expected, got (%v, %v, %v)", len(ieee), p, n, err)
+	}
+}
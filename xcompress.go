@@ -0,0 +1,193 @@
+package xtcp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrInvalidFrame means that the frame is complete but can't be unpacked to one Packet.
+	ErrInvalidFrame = errors.New("xtcp.protocol: invalid frame")
+)
+
+// CompressAlgorithm is the compress algorithm used by CompressProtocol.
+type CompressAlgorithm int
+
+const (
+	// CompressGzip use compress/gzip.
+	CompressGzip CompressAlgorithm = iota
+	// CompressFlate use compress/flate.
+	CompressFlate
+	// CompressZlib use compress/zlib.
+	CompressZlib
+)
+
+// compressPrefixLen is the length of the big endian length prefix of the compressed frames.
+const compressPrefixLen = 4
+
+// CompressProtocol wrap the Inner protocol and compress the packed bytes.
+// Each packet is packed by Inner and compressed into one frame with a 4 bytes big endian length prefix,
+// Unpack decompress a frame only when it is complete, then unpack it by Inner,
+// the decompressed bytes must be exactly one Packet of Inner, otherwise ErrInvalidFrame returned.
+// PackSize need to compress the packet, so it's as expensive as PackTo.
+type CompressProtocol struct {
+	Inner     Protocol
+	Algorithm CompressAlgorithm
+	Level     int // compress level, eg: flate.BestSpeed, gzip and zlib use the same levels as flate.
+	MaxLen    int // max length of the decompressed packet, 0 mean no limit.
+
+	writers sync.Pool
+}
+
+// NewCompressProtocol create a new CompressProtocol.
+// will panic if inner is nil, algorithm is unknown, level is invalid or maxLen is negative.
+func NewCompressProtocol(inner Protocol, algorithm CompressAlgorithm, level int, maxLen int) *CompressProtocol {
+	if inner == nil {
+		panic("xtcp.NewCompressProtocol: nil inner protocol")
+	}
+	switch algorithm {
+	case CompressGzip, CompressFlate, CompressZlib:
+	default:
+		panic("xtcp.NewCompressProtocol: unknown algorithm")
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		panic("xtcp.NewCompressProtocol: invalid level")
+	}
+	if maxLen < 0 {
+		panic("xtcp.NewCompressProtocol: negative max length")
+	}
+	return &CompressProtocol{
+		Inner:     inner,
+		Algorithm: algorithm,
+		Level:     level,
+		MaxLen:    maxLen,
+	}
+}
+
+// compressWriter is the common interface of gzip/flate/zlib writers.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+func (cp *CompressProtocol) getWriter(w io.Writer) (compressWriter, error) {
+	if cw, ok := cp.writers.Get().(compressWriter); ok {
+		cw.Reset(w)
+		return cw, nil
+	}
+	switch cp.Algorithm {
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, cp.Level)
+	case CompressZlib:
+		return zlib.NewWriterLevel(w, cp.Level)
+	default:
+		return flate.NewWriter(w, cp.Level)
+	}
+}
+
+func (cp *CompressProtocol) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch cp.Algorithm {
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressZlib:
+		return zlib.NewReader(r)
+	default:
+		return flate.NewReader(r), nil
+	}
+}
+
+// compress pack the Packet by Inner and return the frame include the prefix.
+func (cp *CompressProtocol) compress(p Packet) ([]byte, error) {
+	raw, err := cp.Inner.Pack(p)
+	if err != nil {
+		return nil, err
+	}
+	if cp.MaxLen > 0 && len(raw) > cp.MaxLen {
+		return nil, ErrPacketTooLong
+	}
+
+	buf := bytes.NewBuffer(make([]byte, compressPrefixLen, compressPrefixLen+len(raw)))
+	cw, err := cp.getWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = cw.Write(raw); err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp.writers.Put(cw)
+
+	frame := buf.Bytes()
+	if uint64(len(frame)-compressPrefixLen) > 1<<32-1 {
+		return nil, ErrPacketTooLong
+	}
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-compressPrefixLen))
+	return frame, nil
+}
+
+// PackSize return the size need for pack the Packet, 0 if pack failed.
+func (cp *CompressProtocol) PackSize(p Packet) int {
+	frame, err := cp.compress(p)
+	if err != nil {
+		return 0
+	}
+	return len(frame)
+}
+
+// PackTo pack the Packet by Inner, then write the compressed frame to w.
+func (cp *CompressProtocol) PackTo(p Packet, w io.Writer) (int, error) {
+	frame, err := cp.compress(p)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(frame)
+}
+
+// Pack pack the Packet to new created buf.
+func (cp *CompressProtocol) Pack(p Packet) ([]byte, error) {
+	return cp.compress(p)
+}
+
+// Unpack try to unpack one compressed frame from buf.
+// return ErrPacketTooLong if the decompressed packet beyond MaxLen, the frame will be discard.
+func (cp *CompressProtocol) Unpack(buf []byte) (Packet, int, error) {
+	payload, n, err := ReadFrame(buf, compressPrefixLen, binary.BigEndian, 0)
+	if err != nil || n == 0 {
+		return nil, n, err
+	}
+
+	r, err := cp.newReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, n, err
+	}
+	var src io.Reader = r
+	if cp.MaxLen > 0 {
+		// don't decompress more than needed, eg: a zip bomb.
+		src = io.LimitReader(r, int64(cp.MaxLen)+1)
+	}
+	raw, err := io.ReadAll(src)
+	r.Close()
+	if err != nil {
+		return nil, n, err
+	}
+	if cp.MaxLen > 0 && len(raw) > cp.MaxLen {
+		return nil, n, ErrPacketTooLong
+	}
+
+	p, pl, err := cp.Inner.Unpack(raw)
+	if err != nil {
+		return nil, n, err
+	}
+	if p == nil || pl != len(raw) {
+		return nil, n, ErrInvalidFrame
+	}
+	return p, n, nil
+}
@@ -0,0 +1,57 @@
+package xtcp
+
+import (
+	"compress/flate"
+	"strings"
+	"testing"
+)
+
+func TestCompressProtocol(t *testing.T) {
+	msg := strings.Repeat("hello ", 100)
+	raw, _ := (&myProtocol{}).Pack(&myPacket{msg: msg})
+	for _, algorithm := range []CompressAlgorithm{CompressGzip, CompressFlate, CompressZlib} {
+		cp := NewCompressProtocol(&myProtocol{}, algorithm, flate.BestSpeed, 1024)
+		buf, err := cp.Pack(&myPacket{msg: msg})
+		if err != nil {
+			t.Errorf("algorithm[%v]: pack err : %v", algorithm, err)
+			continue
+		}
+		if len(buf) >= len(raw) {
+			t.Errorf("algorithm[%v]: compressed len %v expected less than %v", algorithm, len(buf), len(raw))
+		}
+		if size := cp.PackSize(&myPacket{msg: msg}); size != len(buf) {
+			t.Errorf("algorithm[%v]: pack size %v expected, got %v", algorithm, len(buf), size)
+		}
+
+		p, n, err := cp.Unpack(buf[:len(buf)-1])
+		if p != nil || n != 0 || err != nil {
+			t.Errorf("algorithm[%v]: (nil, 0, nil) expected for partial frame, got (%v, %v, %v)", algorithm, p, n, err)
+		}
+
+		// two frames in buf, only the first one unpacked.
+		p, n, err = cp.Unpack(append(buf, buf...))
+		if err != nil || n != len(buf) || p.String() != msg {
+			t.Errorf("algorithm[%v]: (msg, %v, nil) expected, got (%v, %v, %v)", algorithm, len(buf), p, n, err)
+		}
+
+		small := NewCompressProtocol(&myProtocol{}, algorithm, flate.BestSpeed, 100)
+		if _, err := small.Pack(&myPacket{msg: msg}); err != ErrPacketTooLong {
+			t.Errorf("algorithm[%v]: ErrPacketTooLong expected for pack, got %v", algorithm, err)
+		}
+		p, n, err = small.Unpack(buf)
+		if err != ErrPacketTooLong || n != len(buf) || p != nil {
+			t.Errorf("algorithm[%v]: (nil, %v, ErrPacketTooLong) expected, got (%v, %v, %v)", algorithm, len(buf), p, n, err)
+		}
+	}
+
+	// the decompressed bytes is not a complete inner packet.
+	cp := NewCompressProtocol(NewDelimiterProtocol('\n', 0), CompressFlate, flate.DefaultCompression, 0)
+	buf, _ := cp.Pack(DelimiterPacket("hello"))
+	bad, _ := NewCompressProtocol(&myProtocol{}, CompressFlate, flate.DefaultCompression, 0).Pack(&myPacket{msg: "hello"})
+	if p, n, err := cp.Unpack(bad); err != ErrInvalidFrame || n != len(bad) || p != nil {
+		t.Errorf("(nil, %v, ErrInvalidFrame) expected, got (%v, %v, %v)", len(bad), p, n, err)
+	}
+	if p, _, err := cp.Unpack(buf); err != nil || p.String() != "hello" {
+		t.Errorf("(hello, nil) expected, got (%v, %v)", p, err)
+	}
+}
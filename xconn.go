@@ -1,97 +1,663 @@
 package xtcp
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
-	"github.com/xfxdev/xlog"
+	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var (
-	errSendToClosedConn = errors.New("send to closed conn")
-	errSendEmptyBuf     = errors.New("send buf if empty")
+	errSendEmptyBuf = errors.New("send buf if empty")
+	errSendListFull = errors.New("send list is full")
+
+	// ErrConnClosed means that the conn is stopped or closed, eg: send to a closed conn.
+	ErrConnClosed = errors.New("xtcp.conn: conn closed")
+	// ErrSendTimeout means that the packet can't be put to the send list before timeout.
+	ErrSendTimeout = errors.New("xtcp.conn: send timeout")
+	// ErrWriteClosed means that the write side of the conn is closed by CloseWrite.
+	ErrWriteClosed = errors.New("xtcp.conn: write closed")
+	// ErrCloseWriteUnsupported means that the raw conn doesn't support CloseWrite, eg: net.Pipe.
+	ErrCloseWriteUnsupported = errors.New("xtcp.conn: close write unsupported")
+	// ErrHeartbeatTimeout means that no data received from the peer in Options.HeartbeatTimeout.
+	ErrHeartbeatTimeout = errors.New("xtcp.conn: heartbeat timeout")
+	// ErrReadTimeout means that a partial packet is not completed in Options.ReadTimeout.
+	ErrReadTimeout = errors.New("xtcp.conn: read timeout")
+	// ErrHandshakeTimeout means that the first packet is not received in Options.HandshakeTimeout.
+	ErrHandshakeTimeout = errors.New("xtcp.conn: handshake timeout")
+	// ErrPacketDropped means that the packet is dropped by Options.SendOverflowPolicy because the send list is full.
+	ErrPacketDropped = errors.New("xtcp.conn: packet dropped")
+	// ErrNotConnected means that the conn is not established, eg: RawConn is nil.
+	ErrNotConnected = errors.New("xtcp.conn: not connected")
+	// ErrConnServing means that the operation is only allowed before the conn served.
+	ErrConnServing = errors.New("xtcp.conn: conn is serving")
+
+	// lastConnID is the id of last created conn.
+	lastConnID uint64
 )
 
+// PackError is the error of packing a Packet in the send loop, it's reported by EventError, Conn.LastError
+// and SendAndWait. The packet is discarded, the conn is closed if Options.FatalPackError return true.
+type PackError struct {
+	Packet Packet
+	Err    error // the error returned by Protocol.
+}
+
+func (e *PackError) Error() string {
+	return "xtcp.conn: pack error: " + e.Err.Error()
+}
+
+// Unwrap return Err, so errors.Is(err, ErrPacketTooLong) works.
+func (e *PackError) Unwrap() error {
+	return e.Err
+}
+
+// ConnStats is the traffic statistics of a conn.
+type ConnStats struct {
+	BytesSent   uint64
+	BytesRecv   uint64
+	PacketsSent uint64
+	PacketsRecv uint64
+	// PacketsDropped is the number of packets discarded from the send list without sent, because the conn
+	// stopped immediately or the send loop exited on a write error, it's 0 if all the queued packets were written.
+	// It's counted when the conn closed, before EventClosed.
+	PacketsDropped uint64
+}
+
 // A Conn represents the server side of an tcp connection.
 type Conn struct {
+	stats       ConnStats // keep it first for 64-bit alignment of atomic operations.
+	queuedBytes int64     // the bytes in the send list counted by Opts.MaxSendBytes, also 64-bit aligned.
+	id          uint64
 	Opts        *Options
-	RawConn     net.Conn
+	RawConn     net.Conn      // set before serve, see UnderlyingConn.
+	remoteAddr  net.Addr      // the client address from the PROXY protocol header, nil if not set.
+	hsDeadline  time.Time     // the deadline of Opts.HandshakeTimeout, set by the server when accepted.
+	firstRecv   chan struct{} // closed when the first packet received if hsDeadline set.
 	UserData    interface{}
 	sendPackets chan Packet
+	prioPackets chan Packet // the priority packets will be sent before the packets in sendPackets.
 	close       chan struct{}
 	state       int32
+	writeClosed int32 // 1 after CloseWrite called.
+	draining    int32 // 1 after Stop(StopDrainInbound) called, the recv loop stops reading.
+	serving     int32 // 1 after serve started, set with mu held.
+	closeReason int32 // CloseReason, set by the first reason.
 	wg          sync.WaitGroup
+	recvPending sync.WaitGroup  // the EventRecv dispatching by the recv worker pool or the recv queue.
+	recvQueue   chan Packet     // the inbound queue if Opts.RecvQueueLen > 0, closed when the recv loop exit.
+	recvWorkers *recvWorkerPool // the pool of Opts.RecvWorkerPool if used, released after the conn closed.
+	mu          sync.Mutex
+	context     interface{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	server      *Server         // the server accepted the conn, nil for the client conns.
+	tags        map[string]bool // see AddTag, protected by mu.
+	added       bool            // OnConnAdded returned, protected by the mu of server.
+	removed     bool            // removed before OnConnAdded returned, protected by the mu of server.
+	sendDone    chan struct{}   // closed when the send loop exit.
+	recvDone    chan struct{}   // closed when the recv loop exit.
+	writable    chan struct{}   // see WritableNotify, closed when the send loop exit.
+	bytesFreed  chan struct{}   // closed and renewed when the queuedBytes decreased, protected by mu.
+	sendLock    chan struct{}   // the lock of the senders to sendPackets, so SendBatch is contiguous, see lockSend.
+	done        chan struct{}   // closed when serve exit.
+	recvCtx     context.Context // the context of the packet dispatching, only used in the recv loop.
+	protocol    atomic.Value    // protocolHolder set by SetProtocol.
+	lastErr     atomic.Value    // errorHolder set by onError.
+}
+
+// protocolHolder hold the Protocol in atomic.Value, which requires the same concrete type.
+type protocolHolder struct {
+	Protocol
 }
 
 // NewConn return new conn.
 func NewConn(opts *Options) *Conn {
-	return &Conn{
+	return NewConnWithSendListLen(opts, opts.SendListLen)
+}
+
+// NewConnWithSendListLen return new conn with its own length of the send list instead of Opts.SendListLen,
+// eg: a larger one for the bulk transfer conns. will panic if n is negative.
+func NewConnWithSendListLen(opts *Options, n int) *Conn {
+	if n < 0 {
+		panic("xtcp.NewConnWithSendListLen: negative size")
+	}
+	c := &Conn{
+		id:          atomic.AddUint64(&lastConnID, 1),
 		Opts:        opts,
-		sendPackets: make(chan Packet, opts.SendListLen),
+		sendPackets: make(chan Packet, n),
+		prioPackets: make(chan Packet, n),
 		close:       make(chan struct{}),
+		sendDone:    make(chan struct{}),
+		recvDone:    make(chan struct{}),
+		done:        make(chan struct{}),
+		writable:    make(chan struct{}, 1),
+		bytesFreed:  make(chan struct{}),
+		sendLock:    make(chan struct{}, 1),
+	}
+	if opts.RecvQueueLen > 0 {
+		c.recvQueue = make(chan Packet, opts.RecvQueueLen)
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+// setParentCtx derive the context of conn from parent, must be called before serve.
+func (c *Conn) setParentCtx(parent context.Context) {
+	c.cancel()
+	c.ctx, c.cancel = context.WithCancel(parent)
+}
+
+// Ctx return the context of the conn, it will be cancelled when the conn begin to stop.
+// For the conn dialed by DialAndServeContext, it is derived from the ctx passed to DialAndServeContext.
+func (c *Conn) Ctx() context.Context {
+	return c.ctx
+}
+
+// tcpConnOf return the *net.TCPConn of conn, the wrappers like *tls.Conn are unwrapped by NetConn,
+// nil if conn is not a tcp conn.
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			next := c.NetConn()
+			if next == nil || next == conn {
+				return nil
+			}
+			conn = next
+		default:
+			return nil
+		}
+	}
+}
+
+// applyTCPOpts set the tcp options to conn, do nothing if conn is not a tcp conn.
+// The conn wrapped by an accepted tls.NewListener is unwrapped, so the options still apply.
+func applyTCPOpts(conn net.Conn, opts *Options) {
+	tcpConn := tcpConnOf(conn)
+	if tcpConn == nil {
+		return
+	}
+	if opts.KeepAlivePeriod > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(opts.KeepAlivePeriod)
+	}
+	tcpConn.SetNoDelay(opts.NoDelay)
+	if opts.Linger != nil {
+		tcpConn.SetLinger(*opts.Linger)
 	}
 }
 
+// log write the msg with the id and remote address of the conn to the logger of Opts, see FieldLogger.
+func (c *Conn) log(level LogLevel, msg string, fields ...Field) {
+	fields = append([]Field{{FieldConnID, c.id}, {FieldRemoteAddr, c.RemoteAddr()}}, fields...)
+	logFields(c.Opts.logger(), level, msg, fields...)
+}
+
 func (c *Conn) String() string {
-	return c.RawConn.LocalAddr().String() + " -> " + c.RawConn.RemoteAddr().String()
+	if c.RawConn == nil {
+		return fmt.Sprintf("#%d <unconnected>", c.id)
+	}
+	return fmt.Sprintf("#%d %v -> %v", c.id, c.RawConn.LocalAddr(), c.RemoteAddr())
+}
+
+// GetID return the unique id of the conn, the ids are increasing in the order of creation.
+func (c *Conn) GetID() uint64 {
+	return c.id
+}
+
+// LocalAddr return the local address of the conn, nil if the conn is not established.
+// It is still valid after the conn closed.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.RawConn == nil {
+		return nil
+	}
+	return c.RawConn.LocalAddr()
+}
+
+// RemoteAddr return the remote address of the conn, nil if the conn is not established.
+// If Options.EnableProxyProtocol is set, it is the client address in the PROXY protocol header.
+// It is still valid after the conn closed.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	if c.RawConn == nil {
+		return nil
+	}
+	return c.RawConn.RemoteAddr()
+}
+
+// SetDeadline set the read and write deadlines of RawConn, return ErrNotConnected if the conn is not established.
+// Note the recv loop overrides the read deadline if Options.IdleTimeout or Options.ReadTimeout set,
+// and the send loop overrides the write deadline if Options.WriteTimeout set.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if c.RawConn == nil {
+		return ErrNotConnected
+	}
+	return c.RawConn.SetDeadline(t)
+}
+
+// SetReadDeadline set the read deadline of RawConn, return ErrNotConnected if the conn is not established.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.RawConn == nil {
+		return ErrNotConnected
+	}
+	return c.RawConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline set the write deadline of RawConn, return ErrNotConnected if the conn is not established.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.RawConn == nil {
+		return ErrNotConnected
+	}
+	return c.RawConn.SetWriteDeadline(t)
 }
 
 // Stop stops the conn.
 // StopImmediately: immediately closes recv and send.
 // StopGracefullyButNotWait: stop accept new send, but all send bufs in the send list will continue send.
 // StopGracefullyAndWait: stop accept new send, will block until all send bufs in the send list are sended.
+// StopDrainInbound: stop reading, wait until the EventRecv of the packets already received returned,
+// they can still Send, eg: the responses, then stop like StopGracefullyAndWait.
+// The bytes of an incomplete packet are discarded.
+// It is safe to call Stop concurrently or more than once, only the first call stops the conn,
+// except that StopImmediately can still close a conn which is stopping gracefully.
+// The packets put to the send list before a graceful Stop are always sent and flushed before the conn closed,
+// include the ones Send in the Handler right before calling Stop(StopGracefullyButNotWait) in it, eg: a final response.
+// Don't call Stop(StopGracefullyAndWait) or Stop(StopDrainInbound) in the Handler, it will wait for itself.
+// StopImmediately and StopGracefullyButNotWait don't wait for the handler running in other goroutines,
+// but EventClosed is fired after it returned.
 func (c *Conn) Stop(mode StopMode) {
-	if atomic.LoadInt32(&c.state) == 0 {
-		if mode == StopImmediately {
-			atomic.StoreInt32(&c.state, 2)
+	c.setCloseReason(CloseReasonLocalStop)
+	if mode == StopImmediately {
+		if atomic.CompareAndSwapInt32(&c.state, 0, 2) {
 			close(c.close)
+			c.cancel()
 			c.RawConn.Close()
-		} else {
-			atomic.StoreInt32(&c.state, 1)
-			close(c.close)
-			if mode == StopGracefullyAndWait {
-				c.wg.Wait()
-			}
+		} else if atomic.CompareAndSwapInt32(&c.state, 1, 2) {
+			// stopping gracefully, give up the rest packets.
+			c.RawConn.Close()
+		}
+		return
+	}
+	if mode == StopDrainInbound {
+		c.drain()
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&c.state, 0, 1) {
+		close(c.close)
+		c.cancel()
+		if mode == StopGracefullyAndWait {
+			c.wg.Wait()
 		}
 	}
 }
 
+// drain stops the recv loop and waits the received packets dispatched, then stops gracefully and waits.
+func (c *Conn) drain() {
+	if atomic.LoadInt32(&c.state) != 0 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		// wake up the blocking read, the recv loop checks draining after setting its own deadline.
+		c.RawConn.SetReadDeadline(time.Now())
+	}
+	select {
+	case <-c.recvDone:
+	case <-c.done:
+		// serve exit without the recv loop started, eg: OnHandshake failed.
+		return
+	}
+	c.recvPending.Wait()
+	c.Stop(StopGracefullyButNotWait)
+	c.wg.Wait()
+}
+
+// SetProtocol replace the protocol of the conn, the Opts.Protocol is used if not set.
+// It is safe to call in any goroutines, include OnEvent, eg: switch the framing after a version negotiation.
+// The bytes received but not unpacked yet will be unpacked by the new protocol,
+// so call it from OnEvent(EventRecv) of the last packet of the old protocol,
+// the packets in the send list not sent yet will also be packed by the new protocol.
+// Ideally call it in OnHandshake or right after connected, before any data flows.
+// will panic if p is nil.
+func (c *Conn) SetProtocol(p Protocol) {
+	if p == nil {
+		panic("xtcp.Conn.SetProtocol: nil protocol")
+	}
+	c.protocol.Store(protocolHolder{p})
+}
+
+// Protocol return the protocol used by the conn.
+func (c *Conn) Protocol() Protocol {
+	if h, ok := c.protocol.Load().(protocolHolder); ok {
+		return h.Protocol
+	}
+	return c.Opts.Protocol
+}
+
+// CloseReason return why the conn closed, it's valid in and after OnEvent(EventClosed, ...),
+// return CloseReasonNone if the conn is not closing.
+// The first reason wins, eg: the conn stopped by the handler on EventError of a read error is CloseReasonReadError.
+func (c *Conn) CloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&c.closeReason))
+}
+
+// setCloseReason set the close reason if not set yet.
+func (c *Conn) setCloseReason(r CloseReason) {
+	atomic.CompareAndSwapInt32(&c.closeReason, int32(CloseReasonNone), int32(r))
+}
+
 // IsStoped return true if Conn is closed, otherwise return false.
 func (c *Conn) IsStoped() bool {
 	return atomic.LoadInt32(&c.state) == 2
 }
 
-func (c *Conn) serve() {
+// IsClosed return true if the conn is stopping or stopped, Send will return ErrConnClosed in that case.
+// Unlike IsStoped, it is true as soon as Stop called, even if the send list is still draining.
+// A true result is definitive, but false is racy, the conn may be closed right after it returns.
+func (c *Conn) IsClosed() bool {
+	return atomic.LoadInt32(&c.state) != 0
+}
+
+// serve run the OnHandshake hook and fire the et event (EventAccept or EventConnected),
+// then run the recv and send loops until the conn closed.
+// return the error of OnHandshake, the conn is closed without any event if it failed.
+func (c *Conn) serve(et EventType) error {
+	defer close(c.done)
+	c.mu.Lock()
+	// see SetSendListLen.
+	atomic.StoreInt32(&c.serving, 1)
+	c.mu.Unlock()
+
+	if !c.hsDeadline.IsZero() {
+		c.firstRecv = make(chan struct{})
+	}
+
+	if c.Opts.OnHandshake != nil {
+		if !c.hsDeadline.IsZero() {
+			c.RawConn.SetDeadline(c.hsDeadline)
+		}
+		err := c.Opts.OnHandshake(c)
+		if !c.hsDeadline.IsZero() {
+			c.RawConn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			c.log(LogLevelError, "Conn handshake error", Field{FieldError, err})
+			c.Stop(StopImmediately)
+			close(c.writable)
+			return err
+		}
+	}
+	if c.Opts.ProtocolSelector != nil {
+		if p := c.Opts.ProtocolSelector(c); p != nil {
+			c.SetProtocol(p)
+		}
+	}
+
+	// add before the event, so Stop(StopGracefullyAndWait) will not miss them.
+	c.wg.Add(2)
+	if c.Opts.HeartbeatInterval > 0 {
+		c.wg.Add(1)
+	}
+	if c.firstRecv != nil {
+		c.wg.Add(1)
+	}
+	if c.Opts.BackpressureThreshold > 0 && cap(c.sendPackets) > 0 {
+		c.wg.Add(1)
+	}
+	c.Opts.metrics().IncConnections()
+	if c.Opts.LogConnections {
+		c.log(LogLevelInfo, "Conn "+et.String())
+	}
+	c.onEvent(et, nil)
 
+	if c.Opts.HeartbeatInterval > 0 {
+		go c.heartbeat()
+	}
+	if c.firstRecv != nil {
+		go c.handshakeTimeout()
+	}
+	if c.Opts.BackpressureThreshold > 0 && cap(c.sendPackets) > 0 {
+		go c.backpressure()
+	}
+	if c.recvQueue != nil {
+		c.recvPending.Add(1)
+		go c.dispatchQueue()
+	} else {
+		c.recvWorkers = c.Opts.acquireRecvWorkers()
+	}
 	go c.recv()
 	c.send()
 
-	c.Opts.Handler.OnEvent(EventClosed, c, nil)
+	// make sure the raw conn closed, then wait the recv loop exit.
+	c.Stop(StopImmediately)
+	c.wg.Wait()
+	c.recvPending.Wait()
+	if c.recvWorkers != nil {
+		c.Opts.releaseRecvWorkers(c.recvWorkers)
+	}
+	c.dropUnsent()
+
+	c.cancel()
+	c.onEvent(EventClosed, nil)
+	c.Opts.metrics().DecConnections()
+	if c.Opts.LogConnections {
+		c.log(LogLevelInfo, "Conn closed", Field{FieldReason, c.CloseReason()})
+	}
+
+	// release the context after the conn closed.
+	c.SetContext(nil)
+	return nil
+}
+
+// dropUnsent discard the packets left in the send list after the send loop exit, and count them.
+func (c *Conn) dropUnsent() {
+	n := 0
+	for {
+		var p Packet
+		select {
+		case p = <-c.sendPackets:
+		case p = <-c.prioPackets:
+		default:
+			if n > 0 {
+				atomic.AddUint64(&c.stats.PacketsDropped, uint64(n))
+			}
+			return
+		}
+		c.dequeued(p)
+		n++
+	}
+}
+
+// Done return a channel that is closed when the conn finishes serving, after OnEvent(EventClosed, ...) returns,
+// or the OnHandshake failed. It is never closed if the conn is not served, eg: DialAndServe failed to dial.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// SetContext set the user context of the conn, eg: a session object.
+// It is safe to call in any goroutines.
+// The context will be cleared after OnEvent(EventClosed, ...) returns.
+func (c *Conn) SetContext(v interface{}) {
+	c.mu.Lock()
+	c.context = v
+	c.mu.Unlock()
+}
+
+// Context return the user context set by SetContext.
+func (c *Conn) Context() interface{} {
+	c.mu.Lock()
+	v := c.context
+	c.mu.Unlock()
+	return v
+}
+
+// onEvent call the handler, if the handler panics, the conn will be stopped immediately.
+func (c *Conn) onEvent(et EventType, p Packet) {
+	defer func() {
+		if v := recover(); v != nil {
+			if c.Opts.OnPanic != nil {
+				c.Opts.OnPanic(c, v)
+			} else {
+				c.log(LogLevelError, "Conn handler panic", Field{"event", et}, Field{"panic", v}, Field{"stack", string(debug.Stack())})
+			}
+			c.Stop(StopImmediately)
+		}
+	}()
+	c.Opts.Handler.OnEvent(et, c, p)
+}
+
+// onError record the error for LastError, then notify the handler with EventError.
+func (c *Conn) onError(err error) {
+	c.lastErr.Store(errorHolder{err})
+	c.onEvent(EventError, &ErrorPacket{Err: err})
+}
+
+// errorHolder hold the error in atomic.Value, which requires the same concrete type.
+type errorHolder struct {
+	error
+}
+
+// LastError return the last error reported by EventError, nil if none, eg: the write error which closed the conn,
+// so the goroutine calling Send can tell why the conn closed after Send returned ErrConnClosed.
+// It is set before EventError fired, include the errors of the recv loop (io.EOF if the peer closed),
+// the send loop (write error or timeout) and the protocol (pack or unpack error).
+// It is safe to call in any goroutines, and still valid after the conn closed.
+func (c *Conn) LastError() error {
+	if h, ok := c.lastErr.Load().(errorHolder); ok {
+		return h.error
+	}
+	return nil
+}
+
+// UnderlyingConn return the raw conn and whether it's still open, eg: for LocalAddr or SyscallConn.
+// It is safe to call in any goroutines, return (nil, false) before the conn served,
+// after that the raw conn never changes, but false is returned once it's closed by Stop or the serve loop.
+// The raw conn may be closed at any time after it returned, so the operations on it should handle
+// the errors like net.ErrClosed. Don't Read, Write or set the deadlines of it except in OnHandshake,
+// the recv and send loops own them while serving.
+func (c *Conn) UnderlyingConn() (net.Conn, bool) {
+	// RawConn is set before serve, so it's visible after serving loaded.
+	if atomic.LoadInt32(&c.serving) == 0 {
+		return nil, false
+	}
+	return c.RawConn, atomic.LoadInt32(&c.state) != 2
+}
+
+// TLSConnectionState return the state of the tls conn, eg: the negotiated cipher, ALPN protocol and peer certificates,
+// so the handler can authorize the peer in OnHandshake or EventAccept/EventConnected.
+// return false if the conn doesn't use tls or the tls handshake is not completed,
+// the server and DialAndServe both complete the handshake before OnHandshake called.
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	if tlsConn := tlsConnOf(c.RawConn); tlsConn != nil {
+		if state := tlsConn.ConnectionState(); state.HandshakeComplete {
+			return state, true
+		}
+	}
+	return tls.ConnectionState{}, false
+}
+
+// tlsConnOf return the *tls.Conn of conn, the wrappers of it are unwrapped by NetConn, nil if not found.
+func tlsConnOf(conn net.Conn) *tls.Conn {
+	for conn != nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			return tlsConn
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok || nc.NetConn() == conn {
+			return nil
+		}
+		conn = nc.NetConn()
+	}
+	return nil
 }
 
 func (c *Conn) recv() {
 	//defer xlog.Debug("recv exit.")
 	defer c.wg.Done()
+	defer close(c.recvDone)
+	if c.recvQueue != nil {
+		defer close(c.recvQueue)
+	}
+	firstRecv := c.firstRecv
 
-	c.wg.Add(1)
-	recvBuf := NewBuffer(c.Opts.RecvBufInitSize, c.Opts.RecvBufMaxSize)
+	recvBuf := getBuffer(c.Opts.RecvBufInitSize, c.Opts.RecvBufMaxSize)
 	if recvBuf == nil {
-		xlog.Error("Conn Recv error: cann't create recv buf")
+		c.setCloseReason(CloseReasonReadError)
+		c.log(LogLevelError, "Conn Recv error: cann't create recv buf", Field{FieldReason, c.CloseReason()})
+		c.Stop(StopImmediately)
 		return
 	}
+	defer putBuffer(recvBuf)
+
+	chunk := c.Opts.RecvChunkSize
+	if chunk <= 0 {
+		chunk = DefaultRecvChunkSize
+	}
 
 	var tempDelay time.Duration
+	deadline := false // the read deadline is set.
 	for {
-		err := recvBuf.Grow(256)
+		err := recvBuf.Grow(chunk)
 		if err != nil {
-			xlog.Error("Conn Recv error: ", err)
+			c.setCloseReason(CloseReasonReadError)
+			c.log(LogLevelError, "Conn Recv error", Field{FieldError, err}, Field{FieldReason, c.CloseReason()})
+			c.onError(err)
+			c.Stop(StopImmediately)
+			return
+		}
+		// IdleTimeout bound the wait for any data, ReadTimeout bound the wait for the rest of a partial packet,
+		// use the shorter one if both apply.
+		timeout, partial := c.Opts.IdleTimeout, false
+		if recvBuf.UnreadLen() > 0 && c.Opts.ReadTimeout > 0 && (timeout == 0 || c.Opts.ReadTimeout < timeout) {
+			timeout, partial = c.Opts.ReadTimeout, true
+		}
+		if timeout > 0 {
+			c.RawConn.SetReadDeadline(time.Now().Add(timeout))
+			deadline = true
+		} else if deadline {
+			c.RawConn.SetReadDeadline(time.Time{})
+			deadline = false
+		}
+		if atomic.LoadInt32(&c.draining) != 0 {
 			return
 		}
-		_, err = recvBuf.TryRead(c.RawConn)
+		rn, err := recvBuf.TryRead(c.RawConn)
+		if rn > 0 {
+			atomic.AddUint64(&c.stats.BytesRecv, uint64(rn))
+			c.Opts.metrics().AddBytesRecv(rn)
+		}
 		if err != nil {
+			if atomic.LoadInt32(&c.draining) != 0 {
+				// interrupted by Stop(StopDrainInbound).
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && timeout > 0 {
+				if atomic.LoadInt32(&c.state) == 0 {
+					c.setCloseReason(CloseReasonIdleTimeout)
+					if partial {
+						c.log(LogLevelInfo, "Conn Recv read timeout: partial packet not completed, close", Field{"partial", recvBuf.UnreadLen()}, Field{"timeout", timeout}, Field{FieldReason, c.CloseReason()})
+						c.onError(ErrReadTimeout)
+					} else {
+						c.log(LogLevelInfo, "Conn Recv idle timeout: no data received, close", Field{"timeout", timeout}, Field{FieldReason, c.CloseReason()})
+						c.onError(err)
+					}
+					c.Stop(StopImmediately)
+				}
+				return
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -101,15 +667,20 @@ func (c *Conn) recv() {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				xlog.Errorf("Conn Recv error: %v; retrying in %v", err, tempDelay)
+				c.log(LogLevelError, "Conn Recv error, retrying", Field{FieldError, err}, Field{"retry_in", tempDelay})
 				time.Sleep(tempDelay)
 				continue
 			}
 
-			if !c.IsStoped() {
+			// don't stop immediately if stopping gracefully, let the send list drained.
+			if atomic.LoadInt32(&c.state) == 0 {
 				if err != io.EOF {
-					xlog.Error("Conn Recv error: ", err)
+					c.setCloseReason(CloseReasonReadError)
+					c.log(LogLevelError, "Conn Recv error", Field{FieldError, err}, Field{FieldReason, c.CloseReason()})
+				} else {
+					c.setCloseReason(CloseReasonPeerClosed)
 				}
+				c.onError(err)
 				c.Stop(StopImmediately)
 			}
 
@@ -123,33 +694,240 @@ func (c *Conn) recv() {
 				// no buf can unpack.
 				break
 			}
-			p, pl, err := c.Opts.Protocol.Unpack(recvBuf.UnreadBytes())
+			p, pl, err := c.Protocol().Unpack(recvBuf.UnreadBytes())
+			if errors.Is(err, ErrPacketTooLong) {
+				// only the buffered part of the packet can be discarded, the rest would be unpacked as garbage.
+				if atomic.LoadInt32(&c.state) == 0 {
+					c.setCloseReason(CloseReasonProtocolError)
+					c.log(LogLevelError, "Protocol unpack error, close", Field{FieldError, err}, Field{FieldReason, c.CloseReason()})
+					c.onError(err)
+					c.Stop(StopImmediately)
+				}
+				return
+			}
 			if err != nil {
-				xlog.Error("Protocol unpack error: ", err)
+				c.log(LogLevelError, "Protocol unpack error", Field{FieldError, err})
+				c.onError(err)
+			}
+
+			if c.Opts.MaxPacketSize > 0 && pl > c.Opts.MaxPacketSize {
+				c.recvTooLong(pl)
+				return
+			}
+
+			if p != nil && pl <= 0 {
+				// a buggy protocol, the same bytes would be unpacked again and again.
+				if atomic.LoadInt32(&c.state) == 0 {
+					c.setCloseReason(CloseReasonProtocolError)
+					c.log(LogLevelError, "Protocol unpack error, close", Field{FieldError, ErrZeroLengthPacket}, Field{FieldReason, c.CloseReason()})
+					c.onError(ErrZeroLengthPacket)
+					c.Stop(StopImmediately)
+				}
+				return
 			}
 
 			if pl > 0 {
 				_, err = recvBuf.Advance(pl)
 				if err != nil {
-					xlog.Error("Protocol unpack error: ", err)
+					c.log(LogLevelError, "Protocol unpack error", Field{FieldError, err})
 				}
 			}
 
 			if p != nil {
-				c.Opts.Handler.OnEvent(EventRecv, c, p)
+				if firstRecv != nil {
+					close(firstRecv)
+					firstRecv = nil
+				}
+				atomic.AddUint64(&c.stats.PacketsRecv, 1)
+				c.Opts.metrics().IncPacketsRecv()
+				if c.recvQueue != nil {
+					c.recvQueue <- p
+				} else if c.recvWorkers != nil {
+					c.recvWorkers.dispatch(c, p)
+				} else {
+					c.dispatchRecv(p)
+				}
 			} else {
 				break
 			}
 		}
+
+		// the unread bytes is an incomplete packet, it must be longer if beyond the limit.
+		if c.Opts.MaxPacketSize > 0 && recvBuf.UnreadLen() > c.Opts.MaxPacketSize {
+			c.recvTooLong(recvBuf.UnreadLen())
+			return
+		}
+	}
+}
+
+// dispatchQueue fire EventRecv for the packets in the recv queue until it closed.
+func (c *Conn) dispatchQueue() {
+	defer c.recvPending.Done()
+	for p := range c.recvQueue {
+		c.dispatchRecv(p)
+	}
+}
+
+// dispatchRecv fire EventRecv with the Opts.OnBeforeRecv and Opts.OnAfterRecv hooks around it.
+func (c *Conn) dispatchRecv(p Packet) {
+	if c.Opts.OnBeforeRecv == nil && c.Opts.OnAfterRecv == nil {
+		c.onEvent(EventRecv, p)
+		return
+	}
+
+	ctx := c.ctx
+	if c.Opts.OnBeforeRecv != nil {
+		if pctx := c.Opts.OnBeforeRecv(c, p); pctx != nil {
+			ctx = pctx
+		}
+	}
+	c.recvCtx = ctx
+	c.onEvent(EventRecv, p)
+	c.recvCtx = nil
+	if c.Opts.OnAfterRecv != nil {
+		c.Opts.OnAfterRecv(ctx, c, p)
+	}
+}
+
+// RecvCtx return the context returned by Opts.OnBeforeRecv for the packet being dispatched,
+// eg: the context with the tracing span. It's only valid in OnEvent(EventRecv, ...),
+// return Ctx() if OnBeforeRecv not set or returned nil.
+func (c *Conn) RecvCtx() context.Context {
+	if c.recvCtx != nil {
+		return c.recvCtx
+	}
+	return c.ctx
+}
+
+// recvTooLong close the conn because the received packet beyond Opts.MaxPacketSize.
+func (c *Conn) recvTooLong(n int) {
+	if atomic.LoadInt32(&c.state) == 0 {
+		c.setCloseReason(CloseReasonProtocolError)
+		c.log(LogLevelError, "Conn Recv error: packet size beyond the limit, close", Field{"size", n}, Field{"limit", c.Opts.MaxPacketSize}, Field{FieldReason, c.CloseReason()})
+		c.onError(ErrPacketTooLong)
+		c.Stop(StopImmediately)
+	}
+}
+
+// heartbeat send the Opts.HeartbeatPacket if nothing sent in the last interval,
+// and close the conn if nothing received in Opts.HeartbeatTimeout, until the conn begin to stop.
+func (c *Conn) heartbeat() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.Opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	stats := c.Stats()
+	lastRecv := time.Now()
+	for {
+		select {
+		case <-c.close:
+			return
+		case now := <-ticker.C:
+			cur := c.Stats()
+			if cur.BytesRecv != stats.BytesRecv {
+				lastRecv = now
+			} else if c.Opts.HeartbeatTimeout > 0 && now.Sub(lastRecv) >= c.Opts.HeartbeatTimeout {
+				if atomic.LoadInt32(&c.state) == 0 {
+					c.setCloseReason(CloseReasonIdleTimeout)
+					c.log(LogLevelInfo, "Conn heartbeat timeout: no data received, close", Field{"timeout", c.Opts.HeartbeatTimeout}, Field{FieldReason, c.CloseReason()})
+					c.onError(ErrHeartbeatTimeout)
+					c.Stop(StopImmediately)
+				}
+				return
+			}
+			if cur.PacketsSent == stats.PacketsSent && c.SendQueueLen() == 0 && c.Opts.HeartbeatPacket != nil {
+				// idle, don't block if the send list is full.
+				if c.trySend(c.Opts.HeartbeatPacket()) == nil {
+					// not count the heartbeat itself in next interval.
+					cur.PacketsSent++
+				}
+			}
+			stats = cur
+		}
+	}
+}
+
+// handshakeTimeout close the conn if the first packet not received before hsDeadline.
+func (c *Conn) handshakeTimeout() {
+	defer c.wg.Done()
+
+	timer := time.NewTimer(time.Until(c.hsDeadline))
+	defer timer.Stop()
+	select {
+	case <-c.close:
+	case <-c.firstRecv:
+	case <-timer.C:
+		if atomic.LoadInt32(&c.state) == 0 {
+			c.setCloseReason(CloseReasonHandshakeTimeout)
+			c.log(LogLevelInfo, "Conn handshake timeout: no packet received, close", Field{"timeout", c.Opts.HandshakeTimeout}, Field{FieldReason, c.CloseReason()})
+			c.onError(ErrHandshakeTimeout)
+			c.Stop(StopImmediately)
+		}
+	}
+}
+
+// backpressure fire EventBackpressure every Opts.BackpressureThreshold while the send list stays full.
+func (c *Conn) backpressure() {
+	defer c.wg.Done()
+
+	threshold := c.Opts.BackpressureThreshold
+	tick := threshold / 4
+	if tick <= 0 {
+		tick = threshold
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var fullSince time.Time
+	for {
+		select {
+		case <-c.close:
+			return
+		case now := <-ticker.C:
+			if len(c.sendPackets) < cap(c.sendPackets) {
+				fullSince = time.Time{}
+				continue
+			}
+			if fullSince.IsZero() {
+				fullSince = now
+			} else if now.Sub(fullSince) >= threshold {
+				// throttle, fire again after another threshold.
+				fullSince = now
+				c.onEvent(EventBackpressure, nil)
+			}
+		}
 	}
 }
 
 func (c *Conn) sendBuf(buf []byte) error {
-	sended := 0
+	return c.sendBuffers(net.Buffers{buf})
+}
+
+// sendBuffers write all the bufs to the raw conn, use writev if the raw conn supports.
+func (c *Conn) sendBuffers(bufs net.Buffers) error {
 	var tempDelay time.Duration
-	for sended < len(buf) {
-		wn, err := c.RawConn.Write(buf[sended:])
+	for len(bufs) > 0 {
+		if c.Opts.WriteTimeout > 0 {
+			c.RawConn.SetWriteDeadline(time.Now().Add(c.Opts.WriteTimeout))
+		}
+		// WriteTo consume the written bytes of bufs.
+		wn, err := bufs.WriteTo(c.RawConn)
+		if wn > 0 {
+			// count the partial write too, the conn will be closed if err is fatal.
+			atomic.AddUint64(&c.stats.BytesSent, uint64(wn))
+			c.Opts.metrics().AddBytesSent(int(wn))
+		}
 		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.Opts.WriteTimeout > 0 {
+				c.setCloseReason(CloseReasonWriteError)
+				if !c.IsStoped() {
+					c.log(LogLevelInfo, "Conn Send timeout: peer can't read, close", Field{"timeout", c.Opts.WriteTimeout}, Field{FieldReason, c.CloseReason()})
+					c.onError(err)
+				}
+				c.Stop(StopImmediately)
+				return err
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -159,86 +937,1002 @@ func (c *Conn) sendBuf(buf []byte) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				xlog.Errorf("Conn Send error: %v; retrying in %v", err, tempDelay)
+				c.log(LogLevelError, "Conn Send error, retrying", Field{FieldError, err}, Field{"retry_in", tempDelay})
 				time.Sleep(tempDelay)
 				continue
 			}
 
+			c.setCloseReason(CloseReasonWriteError)
 			if !c.IsStoped() {
-				xlog.Error("Conn Send error: ", err)
+				c.log(LogLevelError, "Conn Send error", Field{FieldError, err}, Field{FieldReason, c.CloseReason()})
+				c.onError(err)
 				c.Stop(StopImmediately)
 			}
 			return err
 		}
 		tempDelay = 0
-		sended += wn
 	}
 	return nil
 }
 
-func (c *Conn) send() {
-	//defer xlog.Debug("send exit.")
-	defer c.wg.Done()
+// writerFunc is an adapter to allow the use of function as io.Writer.
+type writerFunc func(p []byte) (int, error)
 
-	c.wg.Add(1)
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
 
-	sendBuf := NewBuffer(256, 2048)
+// waitPacket is the Packet put to the send list by SendAndWait,
+// the result of write will be sent to done.
+type waitPacket struct {
+	Packet
+	done chan error
+}
 
-	for {
-		select {
-		case p := <-c.sendPackets:
-			if c.IsStoped() {
-				return
-			}
-			_, err := c.Opts.Protocol.PackTo(p, sendBuf)
-			if err != nil {
-				xlog.Error("Protocol pack error: ", err)
-				continue
-			}
-			buf, err := sendBuf.Advance(sendBuf.UnreadLen())
-			if err != nil {
-				xlog.Error("Conn Recv error: ", err)
-				continue
+// closeWritePacket is put to the send list by CloseWrite, the result will be sent to done.
+type closeWritePacket struct {
+	done chan error
+}
+
+func (p *closeWritePacket) String() string {
+	return "<close write>"
+}
+
+// flushPacket is put to the send list by Flush, the result of flush will be sent to done.
+type flushPacket struct {
+	done chan error
+}
+
+func (p *flushPacket) String() string {
+	return "<flush>"
+}
+
+// sender is the state of the send loop.
+type sender struct {
+	c       *Conn
+	buf     *Buffer       // used to pack the packets.
+	w       io.Writer     // bw if the write buf enabled, otherwise write to the raw conn directly.
+	bw      *bufio.Writer // nil if the write buf disabled.
+	pending []Packet      // the packets in bw waiting for EventSend, used by SendEventOnWrite.
+	packets []Packet      // the batch packets, used if Opts.WriteBatch > 0.
+	bufs    net.Buffers   // the packed bufs of the batch packets.
+	dones   []chan error  // the waiters of the batch packets.
+	closed  bool          // the write side closed by CloseWrite.
+}
+
+func newSender(c *Conn) *sender {
+	s := &sender{
+		c:   c,
+		buf: NewBuffer(256, 2048),
+	}
+	s.w = writerFunc(func(b []byte) (int, error) {
+		if err := c.sendBuf(b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	})
+	if c.Opts.WriteBufLen > 0 && c.Opts.WriteBatch == 0 {
+		// coalesce the small packets to reduce the write syscalls.
+		s.bw = bufio.NewWriterSize(s.w, c.Opts.WriteBufLen)
+		s.w = s.bw
+	}
+	return s
+}
+
+// flush write the buffered data to the raw conn.
+func (s *sender) flush() error {
+	if s.bw == nil {
+		return nil
+	}
+	err := s.bw.Flush()
+	for i, p := range s.pending {
+		if err == nil {
+			s.c.onEvent(EventSend, p)
+		}
+		s.pending[i] = nil
+	}
+	s.pending = s.pending[:0]
+	return err
+}
+
+// sent fire EventSend for the packet written to the writer by Opts.SendEventTiming.
+func (s *sender) sent(p Packet) {
+	switch s.c.Opts.SendEventTiming {
+	case SendEventOnEnqueue:
+		// fired by Send.
+		return
+	case SendEventOnWrite:
+		if s.bw != nil {
+			// wait for flush.
+			s.pending = append(s.pending, p)
+			return
+		}
+	}
+	s.c.onEvent(EventSend, p)
+}
+
+// send pack the Packet and write it.
+// return error only if write failed, the packet will be discard if pack failed.
+func (s *sender) send(p Packet) error {
+	if cw, ok := p.(*closeWritePacket); ok {
+		return s.closeWrite(cw)
+	}
+	if fp, ok := p.(*flushPacket); ok {
+		err := s.flush()
+		fp.done <- err
+		return err
+	}
+	if s.closed {
+		// discard the packets after closed.
+		if wp, ok := p.(*waitPacket); ok {
+			wp.done <- ErrWriteClosed
+		}
+		return nil
+	}
+	if s.c.Opts.WriteBatch > 0 {
+		return s.sendBatch(p)
+	}
+
+	var done chan error
+	if wp, ok := p.(*waitPacket); ok {
+		p = wp.Packet
+		done = wp.done
+	}
+
+	c := s.c
+	buf, isRaw := p.(RawPacket)
+	if !isRaw {
+		_, err := c.Protocol().PackTo(p, s.buf)
+		if err != nil {
+			// discard the partial packed data.
+			s.buf.Advance(s.buf.UnreadLen())
+			return c.packFailed(p, err, done)
+		}
+		buf, err = s.buf.Advance(s.buf.UnreadLen())
+		if err != nil {
+			c.log(LogLevelError, "Conn Send error", Field{FieldError, err})
+			if done != nil {
+				done <- err
 			}
-			if c.sendBuf(buf) != nil {
-				return
+			return nil
+		}
+	}
+	_, err := s.w.Write(buf)
+	if err == nil && done != nil {
+		// the waiter want to know the packet is written to the conn.
+		err = s.flush()
+	}
+	if err != nil {
+		if done != nil {
+			done <- err
+		}
+		return err
+	}
+
+	atomic.AddUint64(&c.stats.PacketsSent, 1)
+	c.Opts.metrics().IncPacketsSent()
+	if done != nil {
+		done <- nil
+	}
+	s.sent(p)
+	return nil
+}
+
+// closeWrite flush the write buf and close the write side of the raw conn for CloseWrite.
+// return error only if flush failed.
+func (s *sender) closeWrite(cw *closeWritePacket) error {
+	s.closed = true
+	if err := s.flush(); err != nil {
+		cw.done <- err
+		return err
+	}
+	cw.done <- s.c.RawConn.(interface{ CloseWrite() error }).CloseWrite()
+	return nil
+}
+
+// sendBatch take up to Opts.WriteBatch packets from the send list without blocking, first is the first one,
+// pack them and write all of them by one writev.
+// return error only if write failed, the packets failed to pack will be discard.
+func (s *sender) sendBatch(first Packet) error {
+	c := s.c
+	s.packets, s.bufs, s.dones = s.packets[:0], s.bufs[:0], s.dones[:0]
+	var cw *closeWritePacket
+	var fp *flushPacket
+	var fatal error
+	for p, ok := first, true; ok; p, ok = c.tryTake() {
+		if pc, isClose := p.(*closeWritePacket); isClose {
+			// write the batch before close.
+			cw = pc
+			break
+		}
+		if pf, isFlush := p.(*flushPacket); isFlush {
+			// the batch is written directly, the flush is done after it written.
+			fp = pf
+			break
+		}
+		var done chan error
+		if wp, isWait := p.(*waitPacket); isWait {
+			p = wp.Packet
+			done = wp.done
+		}
+		buf, isRaw := p.(RawPacket)
+		var err error
+		if !isRaw {
+			buf, err = c.Protocol().Pack(p)
+		}
+		if err != nil {
+			if fatal = c.packFailed(p, err, done); fatal != nil {
+				// write the packets before it, then close.
+				break
 			}
+		} else {
+			s.packets = append(s.packets, p)
+			s.bufs = append(s.bufs, buf)
+			s.dones = append(s.dones, done)
+		}
+		if len(s.packets) >= c.Opts.WriteBatch {
+			break
+		}
+	}
+	if len(s.packets) == 0 {
+		if fp != nil {
+			fp.done <- nil
+		}
+		if fatal != nil {
+			return fatal
+		}
+		if cw != nil {
+			return s.closeWrite(cw)
+		}
+		return nil
+	}
 
-			c.Opts.Handler.OnEvent(EventSend, c, p)
-		case <-c.close:
-			if atomic.LoadInt32(&c.state) != 1 {
+	err := c.sendBuffers(s.bufs)
+	for i, p := range s.packets {
+		if err == nil {
+			atomic.AddUint64(&c.stats.PacketsSent, 1)
+			c.Opts.metrics().IncPacketsSent()
+		}
+		if s.dones[i] != nil {
+			s.dones[i] <- err
+		}
+		if err == nil {
+			s.sent(p)
+		}
+		s.packets[i], s.bufs[i] = nil, nil
+	}
+	if fp != nil {
+		fp.done <- err
+	}
+	if err == nil && fatal != nil {
+		return fatal
+	}
+	if err == nil && cw != nil {
+		return s.closeWrite(cw)
+	}
+	return err
+}
+
+// packFailed report the error of packing p by EventError and to done of SendAndWait, the packet is discarded.
+// return the *PackError if it's fatal by Opts.FatalPackError, the send loop should exit to close the conn.
+func (c *Conn) packFailed(p Packet, err error, done chan error) error {
+	perr := &PackError{Packet: p, Err: err}
+	fatal := c.Opts.FatalPackError != nil && c.Opts.FatalPackError(p, err)
+	if fatal {
+		c.setCloseReason(CloseReasonProtocolError)
+		c.log(LogLevelError, "Protocol pack error, close", Field{FieldError, err}, Field{FieldReason, c.CloseReason()})
+	} else {
+		c.log(LogLevelError, "Protocol pack error", Field{FieldError, err})
+	}
+	c.onError(perr)
+	if done != nil {
+		done <- perr
+	}
+	if fatal {
+		return perr
+	}
+	return nil
+}
+
+// tryTake take a packet from the send list without blocking, the priority packets first.
+// return false if the send list is empty.
+func (c *Conn) tryTake() (Packet, bool) {
+	select {
+	case p := <-c.prioPackets:
+		return c.dequeued(p), true
+	default:
+	}
+	select {
+	case p := <-c.sendPackets:
+		c.taken()
+		return c.dequeued(p), true
+	default:
+		return nil, false
+	}
+}
+
+// taken notify WritableNotify if the send list was full before the packet taken by the send loop.
+func (c *Conn) taken() {
+	if len(c.sendPackets) == cap(c.sendPackets)-1 {
+		select {
+		case c.writable <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WritableNotify return a channel that receives a signal when the send list turns from full to having room,
+// so the producers can wait on it instead of retrying, eg:
+//
+//	// with SendOverflowDropNewest, Send doesn't block.
+//	for c.Send(p) == xtcp.ErrPacketDropped {
+//		<-c.WritableNotify()
+//	}
+//
+// The signals are coalesced, and a signal may be stale if other producers filled the list again.
+// The channel is closed when the send loop exit or the handshake failed, so the waiters will not leak
+// if the conn closed, Send will return ErrConnClosed then.
+func (c *Conn) WritableNotify() <-chan struct{} {
+	return c.writable
+}
+
+func (c *Conn) send() {
+	//defer xlog.Debug("send exit.")
+	defer c.wg.Done()
+	defer close(c.sendDone)
+	defer close(c.writable)
+
+	s := newSender(c)
+
+	for {
+		var p Packet
+		closed := false
+		// the priority packets first.
+		select {
+		case p = <-c.prioPackets:
+		default:
+			select {
+			case p = <-c.prioPackets:
+			case p = <-c.sendPackets:
+				c.taken()
+			case <-c.close:
+				closed = true
+			}
+		}
+
+		if !closed {
+			p = c.dequeued(p)
+			if c.IsStoped() {
+				// taken from the send list, so dropUnsent will not count it.
+				atomic.AddUint64(&c.stats.PacketsDropped, 1)
 				return
-			} else if len(c.sendPackets) == 0 {
-				// stop when state is closing and send buf list is empty.
-				atomic.StoreInt32(&c.state, 2)
-				c.RawConn.Close()
+			}
+			if s.send(p) != nil {
+				return
+			}
+			if c.SendQueueLen() == 0 && s.flush() != nil {
+				// flush when no more packets to send.
 				return
 			}
+			continue
+		}
+
+		if atomic.LoadInt32(&c.state) != 1 {
+			// stop immediately, discard the packets in send list.
+			return
 		}
+		// stop gracefully, send all the packets in the send list before close.
+		// only this goroutine take packets from the send list, so it will not block.
+		for c.SendQueueLen() > 0 {
+			if len(c.prioPackets) > 0 {
+				p = <-c.prioPackets
+			} else {
+				p = <-c.sendPackets
+			}
+			p = c.dequeued(p)
+			if s.send(p) != nil {
+				return
+			}
+		}
+		if s.flush() != nil {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&c.state, 1, 2) {
+			c.RawConn.Close()
+		}
+		return
 	}
 }
 
 // Send will use the protocol to pack the Packet.
+// It blocks if the send list is full unless Opts.SendOverflowPolicy drops packets,
+// return ErrConnClosed if the conn is stopped, the packet is dropped in that case.
 func (c *Conn) Send(p Packet) error {
-	if atomic.LoadInt32(&c.state) == 0 {
-		c.sendPackets <- p
+	return c.put(false, p)
+}
+
+// SendRaw put the pre-packed bytes to the send list like Send, they will be written verbatim without the Protocol,
+// eg: the bytes packed once and sent to many conns. The order with the packets put by Send is kept.
+// b must be a complete frame of the protocol of the peer, and must not be modified after SendRaw.
+// EventSend will be fired with RawPacket(b).
+func (c *Conn) SendRaw(b []byte) error {
+	return c.Send(RawPacket(b))
+}
+
+// SendPriority is the same as Send, but the packet will be sent before all the packets put by Send,
+// eg: heartbeat or control packets. The priority packets have their own send list with the same length.
+func (c *Conn) SendPriority(p Packet) error {
+	return c.put(true, p)
+}
+
+// SendBatch put all the packets to the send list contiguously like Send, so they are written back to back
+// without the packets of other goroutines between them, eg: the frames of a multi-frame message.
+// It blocks until all of them put to the send list, Opts.SendOverflowPolicy is not applied,
+// since dropping some of them would break the group. The priority packets may still be sent between them.
+// return ErrConnClosed if the conn stopped, the packets before the failed one may be sent in that case.
+func (c *Conn) SendBatch(ps []Packet) error {
+	if err := c.checkSend(); err != nil {
+		return err
+	}
+	if err := c.lockSend(nil); err != nil {
+		return err
+	}
+	n := 0
+	var err error
+	for _, p := range ps {
+		if err = c.putLocked(c.sendPackets, p, SendOverflowBlock); err != nil {
+			break
+		}
+		n++
+	}
+	c.unlockSend()
+
+	for _, p := range ps[:n] {
+		c.enqueued(p)
+	}
+	return err
+}
+
+// lockSend acquire the sendLock, return ErrConnClosed if the conn closed,
+// or ErrSendTimeout if timeout fired before acquired.
+func (c *Conn) lockSend(timeout <-chan time.Time) error {
+	select {
+	case c.sendLock <- struct{}{}:
 		return nil
+	case <-c.close:
+		return ErrConnClosed
+	case <-timeout:
+		return ErrSendTimeout
+	}
+}
+
+func (c *Conn) unlockSend() {
+	<-c.sendLock
+}
+
+// put put the packet to the send list, or the priority list if prio, by Opts.SendOverflowPolicy if it's full.
+func (c *Conn) put(prio bool, p Packet) error {
+	if err := c.checkSend(); err != nil {
+		return err
+	}
+	var ch chan Packet
+	if prio {
+		ch = c.prioPackets
+	} else {
+		if err := c.lockSend(nil); err != nil {
+			return err
+		}
+		// read with sendLock held, SetSendListLen may replace it.
+		ch = c.sendPackets
+	}
+	err := c.putLocked(ch, p, c.Opts.SendOverflowPolicy)
+	if !prio {
+		c.unlockSend()
+	}
+	if err != nil {
+		return err
+	}
+	// fire the event without the lock, the handler may send.
+	c.enqueued(p)
+	return nil
+}
+
+// putLocked put the packet to the send list ch by policy, the sendLock must be held if ch is sendPackets.
+func (c *Conn) putLocked(ch chan Packet, p Packet, policy SendOverflowPolicy) error {
+	q, err := c.reserve(ch, p, policy, nil)
+	if err != nil {
+		return err
+	}
+	switch policy {
+	case SendOverflowDropNewest:
+		select {
+		case ch <- q:
+		default:
+			c.release(q)
+			return ErrPacketDropped
+		}
+	case SendOverflowDropOldest:
+		for {
+			select {
+			case ch <- q:
+				return nil
+			default:
+			}
+			if err := c.dropOldest(ch); err != nil {
+				c.release(q)
+				return err
+			}
+		}
+	default:
+		select {
+		case ch <- q:
+		case <-c.close:
+			c.release(q)
+			return ErrConnClosed
+		}
+	}
+	return nil
+}
+
+// dropOldest drop the oldest packet in the send list ch if any.
+func (c *Conn) dropOldest(ch chan Packet) error {
+	select {
+	case old := <-ch:
+		old = c.dequeued(old)
+		if cw, ok := old.(*closeWritePacket); ok {
+			// CloseWrite called meanwhile, put it back, the new packet would be discarded anyway.
+			select {
+			case ch <- cw:
+			case <-c.close:
+			}
+			return ErrWriteClosed
+		}
+		if wp, ok := old.(*waitPacket); ok {
+			wp.done <- ErrPacketDropped
+		} else if fp, ok := old.(*flushPacket); ok {
+			fp.done <- ErrPacketDropped
+		}
+	default:
+		// taken by the send loop meanwhile.
+	}
+	return nil
+}
+
+// sizedPacket is put to the send list if Opts.MaxSendBytes set, size is counted in queuedBytes.
+type sizedPacket struct {
+	Packet
+	size int64
+}
+
+// queuedSize return the size of p counted by Opts.MaxSendBytes.
+func (c *Conn) queuedSize(p Packet) int64 {
+	if wp, ok := p.(*waitPacket); ok {
+		p = wp.Packet
+	}
+	if b, ok := p.(RawPacket); ok {
+		return int64(len(b))
+	}
+	return int64(c.Protocol().PackSize(p))
+}
+
+// reserve count the size of p in queuedBytes if Opts.MaxSendBytes set, by policy if it beyond the limit,
+// and return the packet to put to the send list ch. It waits until timeout if the policy is SendOverflowBlock.
+// A packet beyond the limit itself is accepted if nothing queued, otherwise it can't be sent ever.
+func (c *Conn) reserve(ch chan Packet, p Packet, policy SendOverflowPolicy, timeout <-chan time.Time) (Packet, error) {
+	if c.Opts.MaxSendBytes <= 0 {
+		return p, nil
+	}
+	size, max := c.queuedSize(p), int64(c.Opts.MaxSendBytes)
+	for {
+		// get the channel before check, so the release after check will not be missed.
+		c.mu.Lock()
+		freed := c.bytesFreed
+		c.mu.Unlock()
+
+		cur := atomic.LoadInt64(&c.queuedBytes)
+		if cur == 0 || cur+size <= max {
+			if atomic.CompareAndSwapInt64(&c.queuedBytes, cur, cur+size) {
+				return &sizedPacket{Packet: p, size: size}, nil
+			}
+			continue
+		}
+		switch policy {
+		case SendOverflowDropNewest:
+			return nil, ErrPacketDropped
+		case SendOverflowDropOldest:
+			if len(ch) > 0 {
+				if err := c.dropOldest(ch); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// the bytes are queued in the other send list, wait the send loop.
+		}
+		select {
+		case <-freed:
+		case <-c.close:
+			return nil, ErrConnClosed
+		case <-timeout:
+			return nil, ErrSendTimeout
+		}
 	}
-	return errSendToClosedConn
+}
+
+// release uncount the packet returned by reserve if it's not put to the send list.
+func (c *Conn) release(q Packet) {
+	if sp, ok := q.(*sizedPacket); ok {
+		c.releaseBytes(sp.size)
+	}
+}
+
+// dequeued uncount the packet taken from the send list and return the packet put by the caller of Send.
+func (c *Conn) dequeued(p Packet) Packet {
+	if sp, ok := p.(*sizedPacket); ok {
+		c.releaseBytes(sp.size)
+		return sp.Packet
+	}
+	return p
+}
+
+func (c *Conn) releaseBytes(n int64) {
+	atomic.AddInt64(&c.queuedBytes, -n)
+	// wake up all the waiters in reserve.
+	c.mu.Lock()
+	close(c.bytesFreed)
+	c.bytesFreed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+// SendQueueBytes return the sum of the sizes of the packets in the send list,
+// it's only counted if Options.MaxSendBytes set, otherwise always 0.
+func (c *Conn) SendQueueBytes() int {
+	return int(atomic.LoadInt64(&c.queuedBytes))
+}
+
+// enqueued fire EventSend if Opts.SendEventTiming is SendEventOnEnqueue, p is put to the send list.
+func (c *Conn) enqueued(p Packet) {
+	if c.Opts.SendEventTiming != SendEventOnEnqueue {
+		return
+	}
+	if wp, ok := p.(*waitPacket); ok {
+		p = wp.Packet
+	}
+	c.onEvent(EventSend, p)
+}
+
+// trySend put the packet to the send list without block.
+func (c *Conn) trySend(p Packet) error {
+	if err := c.checkSend(); err != nil {
+		return err
+	}
+	select {
+	case c.sendLock <- struct{}{}:
+	default:
+		// a SendBatch is blocked.
+		return errSendListFull
+	}
+	q, err := c.reserve(c.sendPackets, p, SendOverflowDropNewest, nil)
+	if err == nil {
+		select {
+		case c.sendPackets <- q:
+		default:
+			c.release(q)
+			err = errSendListFull
+		}
+	}
+	c.unlockSend()
+	if err == ErrPacketDropped {
+		return errSendListFull
+	} else if err != nil {
+		return err
+	}
+	c.enqueued(p)
+	return nil
+}
+
+// Stats return a copy of the traffic statistics of the conn.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		BytesSent:      atomic.LoadUint64(&c.stats.BytesSent),
+		BytesRecv:      atomic.LoadUint64(&c.stats.BytesRecv),
+		PacketsSent:    atomic.LoadUint64(&c.stats.PacketsSent),
+		PacketsRecv:    atomic.LoadUint64(&c.stats.PacketsRecv),
+		PacketsDropped: atomic.LoadUint64(&c.stats.PacketsDropped),
+	}
+}
+
+// SendAndWait put the packet to the send list like Send, and block until
+// the packet written to the conn, return the error of pack or write if any.
+// return ErrConnClosed if the conn stopped before the packet written.
+func (c *Conn) SendAndWait(p Packet) error {
+	wp := &waitPacket{Packet: p, done: make(chan error, 1)}
+	if err := c.Send(wp); err != nil {
+		return err
+	}
+	return c.waitSent(wp.done)
+}
+
+// waitSent wait the result from done sent by the send loop, return ErrConnClosed if the send loop exit.
+func (c *Conn) waitSent(done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-c.sendDone:
+		// the send loop may send the packet before exit.
+		select {
+		case err := <-done:
+			return err
+		default:
+			return ErrConnClosed
+		}
+	}
+}
+
+// CloseWrite flush all the packets put to the send list before, then shut down the write side of the conn,
+// eg: signal the end of request to the peer, but the conn can still receive the response.
+// After called, the send loop discards all the packets and Send returns ErrWriteClosed,
+// the conn keeps running until the peer closed or Stop called.
+// return ErrCloseWriteUnsupported if the raw conn doesn't support CloseWrite, the conn is not affected.
+func (c *Conn) CloseWrite() error {
+	if _, ok := c.RawConn.(interface{ CloseWrite() error }); !ok {
+		return ErrCloseWriteUnsupported
+	}
+	if err := c.checkSend(); err != nil {
+		return err
+	}
+	if !atomic.CompareAndSwapInt32(&c.writeClosed, 0, 1) {
+		return ErrWriteClosed
+	}
+	cw := &closeWritePacket{done: make(chan error, 1)}
+	if err := c.lockSend(nil); err != nil {
+		return err
+	}
+	select {
+	case c.sendPackets <- cw:
+		c.unlockSend()
+	case <-c.close:
+		c.unlockSend()
+		return ErrConnClosed
+	}
+	return c.waitSent(cw.done)
+}
+
+// Flush write all the packets put to the send list before to the conn, include the ones buffered by
+// Opts.WriteBufLen, and block until they written, eg: to override the coalescing at a latency-critical moment.
+// The send loop flushes whenever the send list is empty anyway, Flush makes it happen now.
+// return the write error, ErrConnClosed if the conn stopped before flushed, or ErrWriteClosed after CloseWrite.
+// With SendOverflowDropOldest, it returns ErrPacketDropped if the flush dropped from the send list.
+func (c *Conn) Flush() error {
+	if err := c.checkSend(); err != nil {
+		return err
+	}
+	fp := &flushPacket{done: make(chan error, 1)}
+	if err := c.lockSend(nil); err != nil {
+		return err
+	}
+	select {
+	case c.sendPackets <- fp:
+		c.unlockSend()
+	case <-c.close:
+		c.unlockSend()
+		return ErrConnClosed
+	}
+	return c.waitSent(fp.done)
+}
+
+// checkSend return the error if the conn can't send.
+func (c *Conn) checkSend() error {
+	if atomic.LoadInt32(&c.writeClosed) != 0 {
+		return ErrWriteClosed
+	}
+	if atomic.LoadInt32(&c.state) != 0 {
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// SendQueueLen return the number of packets in the send list which are not sended yet,
+// include the priority packets. It is safe to call in any goroutines.
+func (c *Conn) SendQueueLen() int {
+	return len(c.sendPackets) + len(c.prioPackets)
+}
+
+// RecvQueueLen return the number of packets in the inbound queue not dispatched yet, see Options.RecvQueueLen.
+// It is safe to call in any goroutines.
+func (c *Conn) RecvQueueLen() int {
+	return len(c.recvQueue)
+}
+
+// SendQueueCap return the capacity of the send list, see Options.SendListLen and SetSendListLen.
+func (c *Conn) SendQueueCap() int {
+	return cap(c.sendPackets)
+}
+
+// SetSendListLen replace the length of the send list of the conn, Opts.SendListLen is used if not set.
+// It can't change once the conn served, return ErrConnServing in that case, so call it right after NewConn,
+// or in Opts.OnConnAdded for the server conns, eg: choose by the RemoteAddr.
+// It is safe with serve and Server.Broadcast in other goroutines, and blocks while a Send is blocked
+// on the full send list. The priority list is replaced too, so it must not be called with SendPriority
+// concurrently, the priority packet may be put to the replaced list and lost.
+// The packets already in the send list are kept, n is raised to hold them if less.
+// will panic if n is negative.
+func (c *Conn) SetSendListLen(n int) error {
+	if n < 0 {
+		panic("xtcp.Conn.SetSendListLen: negative size")
+	}
+	// the senders to sendPackets hold sendLock, serve sets serving with mu held,
+	// so the list is never replaced after the send loop started.
+	c.sendLock <- struct{}{}
+	defer c.unlockSend()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&c.serving) != 0 {
+		return ErrConnServing
+	}
+	c.sendPackets = resizeSendList(c.sendPackets, n)
+	c.prioPackets = resizeSendList(c.prioPackets, n)
+	return nil
+}
+
+// resizeSendList return a new send list of length n, or the queued length if larger, with the packets of ch.
+func resizeSendList(ch chan Packet, n int) chan Packet {
+	if len(ch) > n {
+		n = len(ch)
+	}
+	nch := make(chan Packet, n)
+	for len(ch) > 0 {
+		nch <- <-ch
+	}
+	return nch
+}
+
+// SendWithTimeout is the same as Send, but return ErrSendTimeout
+// if the packet can't be put to the send list within d.
+func (c *Conn) SendWithTimeout(p Packet, d time.Duration) error {
+	if err := c.checkSend(); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	if err := c.lockSend(timer.C); err != nil {
+		return err
+	}
+	q, err := c.reserve(c.sendPackets, p, SendOverflowBlock, timer.C)
+	if err == nil {
+		select {
+		case c.sendPackets <- q:
+		case <-c.close:
+			c.release(q)
+			err = ErrConnClosed
+		case <-timer.C:
+			c.release(q)
+			err = ErrSendTimeout
+		}
+	}
+	c.unlockSend()
+	if err != nil {
+		return err
+	}
+	c.enqueued(p)
+	return nil
+}
+
+// splitAddr return the network and address of addr.
+// addr with "unix:" prefix is a unix domain socket path, "tcp4:" or "tcp6:" prefix is a IPv4 or IPv6 only address,
+// otherwise it is a tcp address.
+func splitAddr(addr string) (string, string) {
+	for _, network := range []string{"unix", "tcp4", "tcp6"} {
+		if strings.HasPrefix(addr, network+":") {
+			return network, strings.TrimPrefix(addr, network+":")
+		}
+	}
+	return "tcp", addr
 }
 
 // DialAndServe connects to the addr and serve.
+// addr can be a tcp address like "host:port" or a unix domain socket like "unix:/path/to/socket".
+// If Opts.TLSConfig is not nil, the conn will use tls. It dial by Opts.Dialer if set.
 func (c *Conn) DialAndServe(addr string) error {
-	rawConn, err := net.Dial("tcp", addr)
+	return c.DialAndServeContext(context.Background(), addr)
+}
+
+// DialAndServeContext connects to the addr and serve.
+// It returns ctx.Err() if ctx is done before the conn established.
+// It returns the error of Opts.OnHandshake if the handshake failed.
+// If ctx is done after the conn established, the conn will be stopped immediately.
+func (c *Conn) DialAndServeContext(ctx context.Context, addr string) error {
+	var rawConn net.Conn
+	var err error
+	network, address := splitAddr(addr)
+	d := &net.Dialer{}
+	if c.Opts.Dialer != nil {
+		d = c.Opts.Dialer
+	}
+	hsCtx, cancel := ctx, context.CancelFunc(func() {})
+	if deadline := dialDeadline(d); !deadline.IsZero() {
+		// the tls handshake is bounded by the dialer too, like tls.Dialer.
+		hsCtx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	rawConn, err = d.DialContext(ctx, network, address)
+	if err != nil {
+		cancel()
+		return err
+	}
+	rawConn, err = c.clientHandshake(hsCtx, rawConn, address)
+	cancel()
 	if err != nil {
 		return err
 	}
 
+	applyTCPOpts(rawConn, c.Opts)
 	c.RawConn = rawConn
+	c.setParentCtx(ctx)
 
-	c.Opts.Handler.OnEvent(EventConnected, c, nil)
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Stop(StopImmediately)
+		case <-served:
+		}
+	}()
 
-	c.serve()
+	return c.serve(EventConnected)
+}
 
-	return nil
+// dialDeadline return the earlier of d.Deadline and d.Timeout from now, zero if neither set.
+func dialDeadline(d *net.Dialer) time.Time {
+	deadline := d.Deadline
+	if d.Timeout > 0 {
+		if t := time.Now().Add(d.Timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline
+}
+
+// clientHandshake do the tls handshake of the connected client conn bounded by ctx, if Opts.TLSConfig is not nil,
+// the ServerName is set to the host of addr if empty, like tls.Dialer.
+// return the tls conn, raw is closed if failed.
+func (c *Conn) clientHandshake(ctx context.Context, raw net.Conn, addr string) (net.Conn, error) {
+	if c.Opts.TLSConfig == nil {
+		return raw, nil
+	}
+
+	config := c.Opts.TLSConfig
+	if config.ServerName == "" && addr != "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(raw, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Adopt serve the established raw conn as a client conn like DialAndServe, but without dialing,
+// eg: a conn from a custom accept path, a proxy or a test. EventConnected is fired, and Stop
+// closes raw the same as a dialed conn. If Opts.TLSConfig is not nil, raw is wrapped by tls.Client
+// and the tls handshake is done before serving, raw is closed if it failed, the ServerName is set to
+// the host of raw.RemoteAddr() if empty, like DialAndServe.
+// It blocks until the conn closed, returns the error of the tls handshake or Opts.OnHandshake.
+func (c *Conn) Adopt(raw net.Conn) error {
+	addr := ""
+	if ra := raw.RemoteAddr(); ra != nil {
+		addr = ra.String()
+	}
+	raw, err := c.clientHandshake(context.Background(), raw, addr)
+	if err != nil {
+		return err
+	}
+	applyTCPOpts(raw, c.Opts)
+	c.RawConn = raw
+	return c.serve(EventConnected)
 }
@@ -0,0 +1,94 @@
+package xtcp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// checkPrefixLen panic if prefixLen is not 1/2/4/8.
+func checkPrefixLen(prefixLen int) {
+	switch prefixLen {
+	case 1, 2, 4, 8:
+	default:
+		panic("xtcp: prefix length must be 1, 2, 4 or 8")
+	}
+}
+
+func putFramePrefix(b []byte, order binary.ByteOrder, n int) {
+	switch len(b) {
+	case 1:
+		b[0] = byte(n)
+	case 2:
+		order.PutUint16(b, uint16(n))
+	case 4:
+		order.PutUint32(b, uint32(n))
+	case 8:
+		order.PutUint64(b, uint64(n))
+	}
+}
+
+func framePrefix(b []byte, order binary.ByteOrder) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	default:
+		return order.Uint64(b)
+	}
+}
+
+// maxFramePayloadLen return the max payload length can be described by the prefix and not beyond maxLen.
+func maxFramePayloadLen(prefixLen int, maxLen int) uint64 {
+	max := uint64(1)<<(8*uint(prefixLen)) - 1
+	if prefixLen == 8 {
+		max = 1<<63 - 1
+	}
+	if maxLen > 0 && uint64(maxLen) < max {
+		max = uint64(maxLen)
+	}
+	return max
+}
+
+// ReadFrame try to read one length prefixed frame from buf, the prefix is the length of payload (prefix not included).
+// It's the same as Protocol.Unpack but return the payload, so it can be used to write custom protocols:
+// (nil, 0, nil) : buf size not enough for one frame.
+// (nil, len(buf), ErrPacketTooLong) : the declared length beyond maxLen (0 mean no limit), all the buf should be discard,
+// the rest of the frame may be not received yet, so the stream can't be resynced, the conn closes on it.
+// (payload, n, nil) : buf[:n] is the frame, the payload is a part of buf, copy it if need.
+// will panic if prefixLen is not 1/2/4/8.
+func ReadFrame(buf []byte, prefixLen int, order binary.ByteOrder, maxLen int) ([]byte, int, error) {
+	checkPrefixLen(prefixLen)
+	if len(buf) < prefixLen {
+		return nil, 0, nil
+	}
+	payloadLen := framePrefix(buf[:prefixLen], order)
+	if payloadLen > maxFramePayloadLen(prefixLen, maxLen) {
+		return nil, len(buf), ErrPacketTooLong
+	}
+	if payloadLen > uint64(len(buf)-prefixLen) {
+		return nil, 0, nil
+	}
+	n := prefixLen + int(payloadLen)
+	return buf[prefixLen:n], n, nil
+}
+
+// WriteFrame write the length prefix and payload to w, return ErrPacketTooLong if the payload beyond maxLen
+// (0 mean no limit) or can't be described by the prefix.
+// will panic if prefixLen is not 1/2/4/8.
+func WriteFrame(w io.Writer, payload []byte, prefixLen int, order binary.ByteOrder, maxLen int) (int, error) {
+	checkPrefixLen(prefixLen)
+	if uint64(len(payload)) > maxFramePayloadLen(prefixLen, maxLen) {
+		return 0, ErrPacketTooLong
+	}
+	var prefix [8]byte
+	putFramePrefix(prefix[:prefixLen], order, len(payload))
+	n, err := w.Write(prefix[:prefixLen])
+	if err != nil {
+		return n, err
+	}
+	pn, err := w.Write(payload)
+	return n + pn, err
+}
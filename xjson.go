@@ -0,0 +1,134 @@
+package xtcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	// ErrUnknownJSONType means that the type tag of the json packet is not registered in strict mode.
+	ErrUnknownJSONType = errors.New("xtcp.protocol: unknown json type")
+)
+
+// JSONPacket is the Packet used by JSONProtocol, Value is the decoded message of the Type.
+// Value is a new value of the registered type, or the generic json value (eg: map[string]interface{})
+// if the Type is not registered in lenient mode.
+type JSONPacket struct {
+	Type  string
+	Value interface{}
+}
+
+func (p *JSONPacket) String() string {
+	return p.Type + ":" + fmt.Sprint(p.Value)
+}
+
+// jsonFrame is the json encoded payload of JSONProtocol.
+type jsonFrame struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// JSONProtocol is a LengthPrefixProtocol with 4 bytes big endian prefix,
+// the payload is a json object like {"type":"tag","data":{...}}, data is the message encoded by encoding/json.
+// Unpack return *JSONPacket with the value of the type registered by the tag.
+// PackTo accept *JSONPacket, or any Packet of the registered type which will be tagged by it's type.
+// In strict mode, unknown type tags and unknown fields of the message are errors,
+// otherwise the unknown fields are ignored and the message of unknown type is decoded to the generic json value.
+type JSONProtocol struct {
+	*LengthPrefixProtocol
+	Strict bool
+
+	types map[string]reflect.Type
+	tags  map[reflect.Type]string
+}
+
+// NewJSONProtocol create a new JSONProtocol, maxLen is the max length of the payload, 0 mean no limit.
+// will panic if maxLen is negative.
+func NewJSONProtocol(maxLen int, strict bool) *JSONProtocol {
+	jp := &JSONProtocol{
+		Strict: strict,
+		types:  make(map[string]reflect.Type),
+		tags:   make(map[reflect.Type]string),
+	}
+	jp.LengthPrefixProtocol = NewLengthPrefixProtocol(4, binary.BigEndian, maxLen, jp.encode, jp.decode)
+	return jp
+}
+
+// Register register the type of v with the tag, eg: Register("login", &LoginReq{}),
+// the messages of the tag will be decoded to a new value of the type of v.
+// It is not safe to call concurrently with Pack or Unpack, register all the types before use.
+// will panic if tag is empty, v is nil, or the tag or type is already registered.
+func (jp *JSONProtocol) Register(tag string, v interface{}) *JSONProtocol {
+	if tag == "" || v == nil {
+		panic("xtcp.JSONProtocol.Register: empty tag or nil value")
+	}
+	t := reflect.TypeOf(v)
+	if _, ok := jp.types[tag]; ok {
+		panic("xtcp.JSONProtocol.Register: duplicate tag " + tag)
+	}
+	if _, ok := jp.tags[t]; ok {
+		panic("xtcp.JSONProtocol.Register: duplicate type " + t.String())
+	}
+	jp.types[tag] = t
+	jp.tags[t] = tag
+	return jp
+}
+
+func (jp *JSONProtocol) encode(p Packet) ([]byte, error) {
+	var tag string
+	var v interface{}
+	if jpk, ok := p.(*JSONPacket); ok {
+		tag, v = jpk.Type, jpk.Value
+	} else {
+		v = p
+	}
+	if tag == "" {
+		tag = jp.tags[reflect.TypeOf(v)]
+	}
+	if _, ok := jp.types[tag]; !ok && jp.Strict {
+		return nil, ErrUnknownJSONType
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonFrame{Type: tag, Data: data})
+}
+
+func (jp *JSONProtocol) unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if jp.Strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+func (jp *JSONProtocol) decode(payload []byte) (Packet, error) {
+	var f jsonFrame
+	if err := jp.unmarshal(payload, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Data) == 0 {
+		f.Data = []byte("null")
+	}
+	t, ok := jp.types[f.Type]
+	if !ok {
+		if jp.Strict {
+			return nil, ErrUnknownJSONType
+		}
+		var v interface{}
+		if err := jp.unmarshal(f.Data, &v); err != nil {
+			return nil, err
+		}
+		return &JSONPacket{Type: f.Type, Value: v}, nil
+	}
+	v := reflect.New(t)
+	if err := jp.unmarshal(f.Data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return &JSONPacket{Type: f.Type, Value: v.Elem().Interface()}, nil
+}
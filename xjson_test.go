@@ -0,0 +1,68 @@
+package xtcp
+
+import (
+	"reflect"
+	"testing"
+)
+
+type jsonLogin struct {
+	Name string `json:"name"`
+}
+
+func (l *jsonLogin) String() string {
+	return l.Name
+}
+
+type jsonScore struct {
+	Score int `json:"score"`
+}
+
+func TestJSONProtocol(t *testing.T) {
+	jp := NewJSONProtocol(1024, true).Register("login", &jsonLogin{}).Register("score", jsonScore{})
+
+	tests := []struct {
+		p        Packet
+		expected *JSONPacket
+	}{
+		{&jsonLogin{Name: "xfx"}, &JSONPacket{Type: "login", Value: &jsonLogin{Name: "xfx"}}},
+		{&JSONPacket{Value: &jsonLogin{Name: "dev"}}, &JSONPacket{Type: "login", Value: &jsonLogin{Name: "dev"}}},
+		{&JSONPacket{Type: "score", Value: jsonScore{Score: 99}}, &JSONPacket{Type: "score", Value: jsonScore{Score: 99}}},
+	}
+	for _, test := range tests {
+		buf, err := jp.Pack(test.p)
+		if err != nil {
+			t.Errorf("%v: pack err : %v", test.p, err)
+			continue
+		}
+		p, n, err := jp.Unpack(buf)
+		if err != nil || n != len(buf) || !reflect.DeepEqual(p, test.expected) {
+			t.Errorf("(%v, %v, nil) expected, got (%v, %v, %v)", test.expected, len(buf), p, n, err)
+		}
+	}
+
+	if _, err := jp.Pack(&JSONPacket{Type: "unknown", Value: 1}); err != ErrUnknownJSONType {
+		t.Errorf("ErrUnknownJSONType expected for pack, got %v", err)
+	}
+
+	lenient := NewJSONProtocol(1024, false).Register("login", &jsonLogin{})
+	buf, _ := lenient.Pack(&JSONPacket{Type: "unknown", Value: map[string]int{"a": 1}})
+	if _, _, err := jp.Unpack(buf); err != ErrUnknownJSONType {
+		t.Errorf("ErrUnknownJSONType expected for strict unpack, got %v", err)
+	}
+	p, _, err := lenient.Unpack(buf)
+	expected := &JSONPacket{Type: "unknown", Value: map[string]interface{}{"a": float64(1)}}
+	if err != nil || !reflect.DeepEqual(p, expected) {
+		t.Errorf("%v expected for lenient unpack, got (%v, %v)", expected, p, err)
+	}
+
+	// unknown fields.
+	buf, _ = lenient.Pack(&JSONPacket{Type: "login", Value: map[string]string{"name": "xfx", "extra": "x"}})
+	if p, n, err := jp.Unpack(buf); err == nil || n != len(buf) || p != nil {
+		t.Errorf("(nil, %v, err) expected for strict unpack, got (%v, %v, %v)", len(buf), p, n, err)
+	}
+	p, _, err = lenient.Unpack(buf)
+	expected = &JSONPacket{Type: "login", Value: &jsonLogin{Name: "xfx"}}
+	if err != nil || !reflect.DeepEqual(p, expected) {
+		t.Errorf("%v expected for lenient unpack, got (%v, %v)", expected, p, err)
+	}
+}
@@ -0,0 +1,105 @@
+package xtcp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xfxdev/xlog"
+)
+
+// Logger is the logger used by xtcp, set it by Options.SetLogger to route logs to your own logger.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// DefaultLogger is the default logger of Options, it writes logs by xlog.
+var DefaultLogger Logger = xlogLogger{}
+
+// xlogLogger is the Logger backed by xlog.
+type xlogLogger struct{}
+
+func (xlogLogger) Debugf(format string, v ...interface{}) { xlog.Debugf(format, v...) }
+func (xlogLogger) Infof(format string, v ...interface{})  { xlog.Infof(format, v...) }
+func (xlogLogger) Errorf(format string, v ...interface{}) { xlog.Errorf(format, v...) }
+
+// NopLogger is the Logger which discards all logs, eg: opts.SetLogger(xtcp.NopLogger).
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+
+// LogLevel is the level of a structured log, see FieldLogger.
+type LogLevel int
+
+const (
+	// LogLevelDebug is the level of the debug logs.
+	LogLevelDebug LogLevel = iota
+	// LogLevelInfo is the level of the info logs.
+	LogLevelInfo
+	// LogLevelError is the level of the error logs.
+	LogLevelError
+)
+
+// Field is a key/value pair of a structured log.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// The keys of the fields in the logs of xtcp.
+const (
+	FieldConnID     = "conn_id"     // the id of the conn, see Conn.GetID.
+	FieldRemoteAddr = "remote_addr" // the remote address of the conn.
+	FieldAddr       = "addr"        // the address of the listener or dialed.
+	FieldReason     = "reason"      // why the conn closed, a CloseReason.
+	FieldError      = "error"       // the error caused the log.
+)
+
+// FieldLogger is a Logger which can capture the fields of the logs, eg: backed by log/slog.
+// If the Logger of Options implements it, xtcp calls Log with the fields instead of the format methods,
+// otherwise the fields are formatted as text after the message, eg: `Conn closed conn_id=1 reason="read error"`.
+type FieldLogger interface {
+	Logger
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// logFields write the msg with fields to l by level.
+func logFields(l Logger, level LogLevel, msg string, fields ...Field) {
+	if fl, ok := l.(FieldLogger); ok {
+		fl.Log(level, msg, fields...)
+		return
+	}
+	text := formatFields(msg, fields)
+	switch level {
+	case LogLevelDebug:
+		l.Debugf("%s", text)
+	case LogLevelInfo:
+		l.Infof("%s", text)
+	default:
+		l.Errorf("%s", text)
+	}
+}
+
+// formatFields format the msg and fields as text "msg key=value ...",
+// the values contain spaces, '=' or '"' are quoted, so the text is still parsable.
+func formatFields(msg string, fields []Field) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(f.Value)
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = strconv.Quote(v)
+		}
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(v)
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package xtcp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordLogger) record(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *recordLogger) Debugf(format string, v ...interface{}) { l.record(format, v...) }
+func (l *recordLogger) Infof(format string, v ...interface{})  { l.record(format, v...) }
+func (l *recordLogger) Errorf(format string, v ...interface{}) { l.record(format, v...) }
+
+func TestNopLogger(t *testing.T) {
+	recorder := &recordLogger{}
+	defaultLogger := DefaultLogger
+	DefaultLogger = recorder
+	defer func() {
+		DefaultLogger = defaultLogger
+	}()
+
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).SetLogger(NopLogger))
+	done := make(chan struct{})
+	go func() {
+		server.Serve(l)
+		close(done)
+	}()
+	server.Stop(StopImmediately)
+	<-done
+	l.Close()
+
+	if len(recorder.logs) != 0 {
+		t.Errorf("no output expected with NopLogger, got %v", recorder.logs)
+	}
+
+	// the same server with a recorder should output.
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).SetLogger(recorder)
+	if l, err = net.Listen("tcp", ":"); err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server = NewServer(opts)
+	done = make(chan struct{})
+	go func() {
+		server.Serve(l)
+		close(done)
+	}()
+	server.Stop(StopImmediately)
+	<-done
+	if len(recorder.logs) == 0 {
+		t.Error("output expected with recorder logger")
+	}
+}
+
+type fieldLog struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+type fieldRecorder struct {
+	recordLogger
+	fieldLogs chan fieldLog
+}
+
+func (l *fieldRecorder) Log(level LogLevel, msg string, fields ...Field) {
+	fl := fieldLog{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		fl.fields[f.Key] = f.Value
+	}
+	l.fieldLogs <- fl
+}
+
+func TestFieldLogger(t *testing.T) {
+	recorder := &fieldRecorder{fieldLogs: make(chan fieldLog, 10)}
+	server, client := net.Pipe()
+	defer client.Close()
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).
+		SetLogger(recorder).SetIdleTimeout(10 * time.Millisecond))
+	c.RawConn = server
+	go c.serve(EventAccept)
+	<-c.Done()
+
+	select {
+	case fl := <-recorder.fieldLogs:
+		if fl.level != LogLevelInfo || fl.fields[FieldConnID] != c.GetID() ||
+			fl.fields[FieldRemoteAddr] != c.RemoteAddr() || fl.fields[FieldReason] != CloseReasonIdleTimeout {
+			t.Errorf("idle timeout log with the fields of the conn expected, got %+v", fl)
+		}
+	default:
+		t.Error("idle timeout log expected")
+	}
+	if len(recorder.logs) != 0 {
+		t.Errorf("no text logs expected with FieldLogger, got %v", recorder.logs)
+	}
+
+	// the fields are formatted as text for the Logger.
+	text := &recordLogger{}
+	logFields(text, LogLevelError, "Conn closed", Field{FieldConnID, 1}, Field{FieldReason, CloseReasonReadError})
+	if len(text.logs) != 1 || text.logs[0] != `Conn closed conn_id=1 reason="read error"` {
+		t.Errorf("formatted text expected, got %v", text.logs)
+	}
+}
+
+func TestLogConnections(t *testing.T) {
+	recorder := &fieldRecorder{fieldLogs: make(chan fieldLog, 10)}
+	clientOpts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).
+		SetLogger(recorder).SetLogConnections(true)
+	serverOpts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).SetLogger(NopLogger)
+	client, server := NewPipeConns(clientOpts, serverOpts)
+
+	fl := <-recorder.fieldLogs
+	if fl.level != LogLevelInfo || fl.msg != "Conn connected" || fl.fields[FieldConnID] != client.GetID() ||
+		fl.fields[FieldRemoteAddr] != client.RemoteAddr() {
+		t.Errorf("connected log with the conn id and remote addr expected, got %+v", fl)
+	}
+	client.Stop(StopImmediately)
+	<-client.Done()
+	<-server.Done()
+	for len(recorder.fieldLogs) > 0 {
+		if fl = <-recorder.fieldLogs; fl.msg == "Conn closed" {
+			break
+		}
+	}
+	if fl.msg != "Conn closed" || fl.fields[FieldReason] != CloseReasonLocalStop {
+		t.Errorf("closed log with the close reason expected, got %+v", fl)
+	}
+}
@@ -0,0 +1,30 @@
+package xtcp
+
+// Metrics is the hook to collect the metrics of conns, eg: adapt it to prometheus collectors.
+// The methods may be called concurrently by multiple conns, so they must be safe for concurrent use.
+type Metrics interface {
+	// IncConnections is called when a conn begin to serve, before EventAccept or EventConnected.
+	IncConnections()
+	// DecConnections is called after the conn closed, after EventClosed.
+	DecConnections()
+	// AddBytesSent is called after n bytes written to the conn.
+	AddBytesSent(n int)
+	// AddBytesRecv is called after n bytes read from the conn.
+	AddBytesRecv(n int)
+	// IncPacketsSent is called after a packet sent.
+	IncPacketsSent()
+	// IncPacketsRecv is called after a packet unpacked.
+	IncPacketsRecv()
+}
+
+// NopMetrics is the Metrics which does nothing, it is used if Options.Metrics is nil.
+var NopMetrics Metrics = nopMetrics{}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncConnections()    {}
+func (nopMetrics) DecConnections()    {}
+func (nopMetrics) AddBytesSent(n int) {}
+func (nopMetrics) AddBytesRecv(n int) {}
+func (nopMetrics) IncPacketsSent()    {}
+func (nopMetrics) IncPacketsRecv()    {}
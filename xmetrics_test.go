@@ -0,0 +1,64 @@
+package xtcp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type countMetrics struct {
+	conns, bytesSent, bytesRecv, packetsSent, packetsRecv int64
+}
+
+func (m *countMetrics) IncConnections()    { atomic.AddInt64(&m.conns, 1) }
+func (m *countMetrics) DecConnections()    { atomic.AddInt64(&m.conns, -1) }
+func (m *countMetrics) AddBytesSent(n int) { atomic.AddInt64(&m.bytesSent, int64(n)) }
+func (m *countMetrics) AddBytesRecv(n int) { atomic.AddInt64(&m.bytesRecv, int64(n)) }
+func (m *countMetrics) IncPacketsSent()    { atomic.AddInt64(&m.packetsSent, 1) }
+func (m *countMetrics) IncPacketsRecv()    { atomic.AddInt64(&m.packetsRecv, 1) }
+
+func TestMetrics(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	serverMetrics := &countMetrics{}
+	recved := make(chan struct{})
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			close(recved)
+		}
+	}), p).SetMetrics(serverMetrics))
+	go server.Serve(l)
+
+	clientMetrics := &countMetrics{}
+	connected := make(chan struct{})
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventConnected {
+			if n := atomic.LoadInt64(&clientMetrics.conns); n != 1 {
+				t.Errorf("1 conn expected before EventConnected, got %v", n)
+			}
+			close(connected)
+		}
+	}), p).SetMetrics(clientMetrics))
+	go client.DialAndServe(l.Addr().String())
+	<-connected
+
+	client.SendAndWait(&myPacket{msg: "hello"})
+	<-recved
+	server.Stop(StopGracefullyAndWait)
+	<-client.Done()
+
+	if clientMetrics.conns != 0 || serverMetrics.conns != 0 {
+		t.Errorf("0 conn expected after closed, got client %v, server %v", clientMetrics.conns, serverMetrics.conns)
+	}
+	stats := client.Stats()
+	if clientMetrics.packetsSent != 1 || clientMetrics.bytesSent != int64(stats.BytesSent) {
+		t.Errorf("1 packet %v bytes sent expected, got %v packets %v bytes", stats.BytesSent, clientMetrics.packetsSent, clientMetrics.bytesSent)
+	}
+	if serverMetrics.packetsRecv != 1 || serverMetrics.bytesRecv != int64(stats.BytesSent) {
+		t.Errorf("1 packet %v bytes recv expected, got %v packets %v bytes", stats.BytesSent, serverMetrics.packetsRecv, serverMetrics.bytesRecv)
+	}
+}
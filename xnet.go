@@ -0,0 +1,35 @@
+package xtcp
+
+import (
+	"context"
+	"net"
+)
+
+// Listen listens on addr by cfg, the socket options can be set by cfg.Control before bind, eg: SO_REUSEADDR:
+//
+//	l, err := xtcp.Listen(":8080", net.ListenConfig{
+//		Control: func(network, address string, c syscall.RawConn) error {
+//			var opErr error
+//			err := c.Control(func(fd uintptr) {
+//				opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+//			})
+//			if err != nil {
+//				return err
+//			}
+//			return opErr
+//		},
+//	})
+//
+// addr can be a tcp address like "host:port" or a unix domain socket like "unix:/path/to/socket",
+// use "tcp4:host:port" or "tcp6:host:port" to listen on IPv4 or IPv6 only.
+func Listen(addr string, cfg net.ListenConfig) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	return cfg.Listen(context.Background(), network, address)
+}
+
+// Dial connects to addr by d, the socket options can be set by d.Control like Listen.
+// addr is the same as Listen. Use Options.SetDialer to let DialAndServe dial by d.
+func Dial(addr string, d net.Dialer) (net.Conn, error) {
+	network, address := splitAddr(addr)
+	return d.Dial(network, address)
+}
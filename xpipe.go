@@ -0,0 +1,30 @@
+package xtcp
+
+import (
+	"net"
+)
+
+// NewPipeConns create a pair of conns connected by the in-memory net.Pipe and start serving both of them,
+// so the protocols and handlers can be tested without the sockets, eg:
+//
+//	client, server := xtcp.NewPipeConns(clientOpts, serverOpts)
+//	defer client.Stop(xtcp.StopImmediately)
+//	client.Send(p)
+//
+// The client receives EventConnected and the server receives EventAccept, serverOpts nil mean the same as clientOpts.
+// The tcp options, TLSConfig and the options of Server are ignored, and net.Pipe is synchronous,
+// so a write blocks until the peer reads it.
+// Stop either one will close the other, use Done to wait them closed.
+func NewPipeConns(clientOpts, serverOpts *Options) (client, server *Conn) {
+	if serverOpts == nil {
+		serverOpts = clientOpts
+	}
+	cp, sp := net.Pipe()
+	client = NewConn(clientOpts)
+	client.RawConn = cp
+	server = NewConn(serverOpts)
+	server.RawConn = sp
+	go client.serve(EventConnected)
+	go server.serve(EventAccept)
+	return client, server
+}
@@ -0,0 +1,70 @@
+// Package xproto provide the protobuf protocol for xtcp,
+// it's a separate package so xtcp itself doesn't depend on protobuf.
+package xproto
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/xfxdev/xtcp"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	errNotMessage = errors.New("xproto: the packet is not a proto.Message")
+)
+
+// Packet wrap the proto.Message which doesn't implement xtcp.Packet.
+type Packet struct {
+	proto.Message
+}
+
+func (p *Packet) String() string {
+	return prototext.MarshalOptions{}.Format(p.Message)
+}
+
+// ProtobufProtocol is a xtcp.LengthPrefixProtocol with 4 bytes big endian prefix,
+// the payload is the message marshaled by google.golang.org/protobuf/proto.
+// Unpack create a fresh message by New and unmarshal the payload to it, return the message itself
+// if it implements xtcp.Packet (the generated messages do), otherwise return it wrapped by *Packet.
+// PackTo accept the message implements xtcp.Packet or *Packet.
+type ProtobufProtocol struct {
+	*xtcp.LengthPrefixProtocol
+	New func() proto.Message
+}
+
+// NewProtobufProtocol create a new ProtobufProtocol, maxLen is the max length of the payload, 0 mean no limit.
+// will panic if newMsg is nil or maxLen is negative.
+func NewProtobufProtocol(newMsg func() proto.Message, maxLen int) *ProtobufProtocol {
+	if newMsg == nil {
+		panic("xproto.NewProtobufProtocol: nil message factory")
+	}
+	pp := &ProtobufProtocol{
+		New: newMsg,
+	}
+	pp.LengthPrefixProtocol = xtcp.NewLengthPrefixProtocol(4, binary.BigEndian, maxLen, pp.encode, pp.decode)
+	return pp
+}
+
+func (pp *ProtobufProtocol) encode(p xtcp.Packet) ([]byte, error) {
+	if w, ok := p.(*Packet); ok {
+		return proto.Marshal(w.Message)
+	}
+	m, ok := p.(proto.Message)
+	if !ok {
+		return nil, errNotMessage
+	}
+	return proto.Marshal(m)
+}
+
+func (pp *ProtobufProtocol) decode(payload []byte) (xtcp.Packet, error) {
+	m := pp.New()
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return nil, err
+	}
+	if p, ok := m.(xtcp.Packet); ok {
+		return p, nil
+	}
+	return &Packet{m}, nil
+}
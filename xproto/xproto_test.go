@@ -0,0 +1,41 @@
+package xproto
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtobufProtocol(t *testing.T) {
+	pp := NewProtobufProtocol(func() proto.Message { return &wrapperspb.StringValue{} }, 1024)
+	buf, err := pp.Pack(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal("pack err : ", err)
+	}
+
+	p, n, err := pp.Unpack(buf[:len(buf)-1])
+	if p != nil || n != 0 || err != nil {
+		t.Errorf("(nil, 0, nil) expected for partial frame, got (%v, %v, %v)", p, n, err)
+	}
+	p, n, err = pp.Unpack(append(buf, buf...))
+	if err != nil || n != len(buf) {
+		t.Fatalf("(msg, %v, nil) expected, got (%v, %v, %v)", len(buf), p, n, err)
+	}
+	if msg, ok := p.(*wrapperspb.StringValue); !ok || msg.GetValue() != "hello" {
+		t.Errorf("hello expected, got %v", p)
+	}
+
+	// the wrapped message.
+	buf, err = pp.Pack(&Packet{wrapperspb.String("wrapped")})
+	if err != nil {
+		t.Fatal("pack err : ", err)
+	}
+	if p, _, err := pp.Unpack(buf); err != nil || p.(*wrapperspb.StringValue).GetValue() != "wrapped" {
+		t.Errorf("wrapped expected, got (%v, %v)", p, err)
+	}
+
+	if _, _, err := pp.Unpack([]byte{0, 0, 0, 1, 0xff}); err == nil {
+		t.Error("error expected for invalid payload")
+	}
+}
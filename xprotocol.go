@@ -0,0 +1,181 @@
+package xtcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrPacketTooLong means that the packet size beyond the upper limit of protocol.
+	// The conn is closed with CloseReasonProtocolError if Unpack returns it, the stream can't be resynced.
+	ErrPacketTooLong = errors.New("xtcp.protocol: packet too long")
+	// ErrZeroLengthPacket means that Unpack return a Packet but consumed no bytes, the conn will be closed.
+	ErrZeroLengthPacket = errors.New("xtcp.protocol: unpacked packet consumed no bytes")
+)
+
+// PackOnce pack the Packet by proto to a new created buf, which can be sent to many conns by
+// Conn.SendRaw or Server.BroadcastRaw without packing for each conn.
+// The conns must use the same protocol as proto.
+func PackOnce(p Packet, proto Protocol) ([]byte, error) {
+	return proto.Pack(p)
+}
+
+// DelimiterPacket is the Packet used by DelimiterProtocol, the delimiter is not included.
+type DelimiterPacket []byte
+
+func (p DelimiterPacket) String() string {
+	return string(p)
+}
+
+// DelimiterProtocol frame the packets by a delimiter, eg: '\n' for line-oriented protocols.
+// Unpack return DelimiterPacket, PackTo accept DelimiterPacket or any Packet by it's String().
+type DelimiterProtocol struct {
+	Delimiter byte
+	MaxLen    int // max length of one packet include the delimiter, 0 mean no limit.
+}
+
+// NewDelimiterProtocol create a new DelimiterProtocol.
+// will panic if maxLen is negative.
+func NewDelimiterProtocol(delimiter byte, maxLen int) *DelimiterProtocol {
+	if maxLen < 0 {
+		panic("xtcp.NewDelimiterProtocol: negative max length")
+	}
+	return &DelimiterProtocol{
+		Delimiter: delimiter,
+		MaxLen:    maxLen,
+	}
+}
+
+func (dp *DelimiterProtocol) payload(p Packet) []byte {
+	if b, ok := p.(DelimiterPacket); ok {
+		return b
+	}
+	return []byte(p.String())
+}
+
+// PackSize return the size need for pack the Packet.
+func (dp *DelimiterProtocol) PackSize(p Packet) int {
+	return len(dp.payload(p)) + 1
+}
+
+// PackTo pack the Packet and the delimiter to w.
+func (dp *DelimiterProtocol) PackTo(p Packet, w io.Writer) (int, error) {
+	b := dp.payload(p)
+	if dp.MaxLen > 0 && len(b)+1 > dp.MaxLen {
+		return 0, ErrPacketTooLong
+	}
+	n, err := w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	dn, err := w.Write([]byte{dp.Delimiter})
+	return n + dn, err
+}
+
+// Pack pack the Packet to new created buf.
+func (dp *DelimiterProtocol) Pack(p Packet) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, dp.PackSize(p)))
+	_, err := dp.PackTo(p, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unpack scan the buf for the delimiter.
+// return (nil, 0, nil) if the delimiter not found and the buf not beyond MaxLen.
+// return ErrPacketTooLong if the delimiter not found within MaxLen bytes, the scanned bytes will be discard.
+func (dp *DelimiterProtocol) Unpack(buf []byte) (Packet, int, error) {
+	i := bytes.IndexByte(buf, dp.Delimiter)
+	if i < 0 {
+		if dp.MaxLen > 0 && len(buf) >= dp.MaxLen {
+			return nil, len(buf), ErrPacketTooLong
+		}
+		return nil, 0, nil
+	}
+	if dp.MaxLen > 0 && i+1 > dp.MaxLen {
+		return nil, i + 1, ErrPacketTooLong
+	}
+	// copy it, buf will be reused after unpack.
+	p := make(DelimiterPacket, i)
+	copy(p, buf[:i])
+	return p, i + 1, nil
+}
+
+// LengthPrefixProtocol frame the packets by a length prefix, the length is the size of payload (prefix not included).
+// The payload is encoded/decoded by Encode/Decode.
+type LengthPrefixProtocol struct {
+	PrefixLen int              // 1, 2, 4 or 8 bytes.
+	ByteOrder binary.ByteOrder // byte order of the prefix.
+	MaxLen    int              // max length of the payload, 0 mean no limit.
+	// Encode encode the Packet to payload.
+	Encode func(p Packet) ([]byte, error)
+	// Decode decode the payload to Packet.
+	// The payload is valid for use only until Decode returns, copy it if need.
+	Decode func(payload []byte) (Packet, error)
+}
+
+// NewLengthPrefixProtocol create a new LengthPrefixProtocol.
+// will panic if prefixLen is not 1/2/4/8, order/encode/decode is nil or maxLen is negative.
+func NewLengthPrefixProtocol(prefixLen int, order binary.ByteOrder, maxLen int,
+	encode func(p Packet) ([]byte, error), decode func(payload []byte) (Packet, error)) *LengthPrefixProtocol {
+	checkPrefixLen(prefixLen)
+	if order == nil || encode == nil || decode == nil {
+		panic("xtcp.NewLengthPrefixProtocol: nil byte order, encode or decode")
+	}
+	if maxLen < 0 {
+		panic("xtcp.NewLengthPrefixProtocol: negative max length")
+	}
+	return &LengthPrefixProtocol{
+		PrefixLen: prefixLen,
+		ByteOrder: order,
+		MaxLen:    maxLen,
+		Encode:    encode,
+		Decode:    decode,
+	}
+}
+
+// PackSize return the size need for pack the Packet, 0 if encode failed.
+func (lp *LengthPrefixProtocol) PackSize(p Packet) int {
+	payload, err := lp.Encode(p)
+	if err != nil {
+		return 0
+	}
+	return lp.PrefixLen + len(payload)
+}
+
+// PackTo pack the prefix and payload of the Packet to w.
+func (lp *LengthPrefixProtocol) PackTo(p Packet, w io.Writer) (int, error) {
+	payload, err := lp.Encode(p)
+	if err != nil {
+		return 0, err
+	}
+	return WriteFrame(w, payload, lp.PrefixLen, lp.ByteOrder, lp.MaxLen)
+}
+
+// Pack pack the Packet to new created buf.
+func (lp *LengthPrefixProtocol) Pack(p Packet) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	_, err := lp.PackTo(p, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unpack try to unpack one frame from buf.
+// return ErrPacketTooLong if the declared length beyond MaxLen, all the buf will be discard
+// and the conn closed, the rest of the frame would be unpacked as garbage otherwise.
+func (lp *LengthPrefixProtocol) Unpack(buf []byte) (Packet, int, error) {
+	payload, n, err := ReadFrame(buf, lp.PrefixLen, lp.ByteOrder, lp.MaxLen)
+	if err != nil || n == 0 {
+		return nil, n, err
+	}
+	p, err := lp.Decode(payload)
+	if err != nil {
+		return nil, n, err
+	}
+	return p, n, nil
+}
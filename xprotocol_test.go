@@ -0,0 +1,100 @@
+package xtcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDelimiterProtocol(t *testing.T) {
+	dp := NewDelimiterProtocol('\n', 8)
+	buf, err := dp.Pack(DelimiterPacket("hello"))
+	if err != nil {
+		t.Error("pack err : ", err)
+	}
+	if string(buf) != "hello\n" {
+		t.Errorf("'hello\\n' expected, got %q", buf)
+	}
+
+	p, n, err := dp.Unpack([]byte("hel"))
+	if p != nil || n != 0 || err != nil {
+		t.Errorf("(nil, 0, nil) expected for partial buf, got (%v, %v, %v)", p, n, err)
+	}
+
+	p, n, err = dp.Unpack([]byte("hello\nworld"))
+	if err != nil || n != 6 || p.String() != "hello" {
+		t.Errorf("(hello, 6, nil) expected, got (%v, %v, %v)", p, n, err)
+	}
+
+	p, n, err = dp.Unpack([]byte("toolongline"))
+	if err != ErrPacketTooLong || n != 11 || p != nil {
+		t.Errorf("(nil, 11, ErrPacketTooLong) expected, got (%v, %v, %v)", p, n, err)
+	}
+}
+
+func TestLengthPrefixProtocol(t *testing.T) {
+	encode := func(p Packet) ([]byte, error) { return []byte(p.String()), nil }
+	decode := func(payload []byte) (Packet, error) { return &myPacket{msg: string(payload)}, nil }
+
+	for _, prefixLen := range []int{1, 2, 4, 8} {
+		lp := NewLengthPrefixProtocol(prefixLen, binary.LittleEndian, 16, encode, decode)
+		buf, err := lp.Pack(&myPacket{msg: "hello"})
+		if err != nil || len(buf) != prefixLen+5 {
+			t.Errorf("prefix[%v]: pack err : %v, len : %v", prefixLen, err, len(buf))
+			continue
+		}
+
+		p, n, err := lp.Unpack(buf[:len(buf)-1])
+		if p != nil || n != 0 || err != nil {
+			t.Errorf("prefix[%v]: (nil, 0, nil) expected for partial frame, got (%v, %v, %v)", prefixLen, p, n, err)
+		}
+
+		p, n, err = lp.Unpack(buf)
+		if err != nil || n != len(buf) || p.String() != "hello" {
+			t.Errorf("prefix[%v]: (hello, %v, nil) expected, got (%v, %v, %v)", prefixLen, len(buf), p, n, err)
+		}
+
+		if _, err = lp.Pack(&myPacket{msg: "a very long message"}); err != ErrPacketTooLong {
+			t.Errorf("prefix[%v]: 'ErrPacketTooLong' expected for pack, got %v", prefixLen, err)
+		}
+	}
+
+	lp := NewLengthPrefixProtocol(4, binary.BigEndian, 16, encode, decode)
+	_, _, err := lp.Unpack([]byte{0, 0, 1, 0})
+	if err != ErrPacketTooLong {
+		t.Errorf("'ErrPacketTooLong' expected for unpack, got %v", err)
+	}
+}
+
+func TestReadWriteFrame(t *testing.T) {
+	for _, prefixLen := range []int{1, 2, 4, 8} {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			var buf bytes.Buffer
+			if _, err := WriteFrame(&buf, []byte("hello"), prefixLen, order, 8); err != nil {
+				t.Errorf("prefix[%v]: write err : %v", prefixLen, err)
+				continue
+			}
+			WriteFrame(&buf, nil, prefixLen, order, 8)
+			frames := buf.Bytes()
+
+			if payload, n, err := ReadFrame(frames[:prefixLen+4], prefixLen, order, 8); payload != nil || n != 0 || err != nil {
+				t.Errorf("prefix[%v]: (nil, 0, nil) expected for partial frame, got (%q, %v, %v)", prefixLen, payload, n, err)
+			}
+			payload, n, err := ReadFrame(frames, prefixLen, order, 8)
+			if err != nil || n != prefixLen+5 || string(payload) != "hello" {
+				t.Errorf("prefix[%v]: (hello, %v, nil) expected, got (%q, %v, %v)", prefixLen, prefixLen+5, payload, n, err)
+			}
+			// the empty frame.
+			if payload, n, err := ReadFrame(frames[n:], prefixLen, order, 8); err != nil || n != prefixLen || len(payload) != 0 {
+				t.Errorf("prefix[%v]: (\"\", %v, nil) expected, got (%q, %v, %v)", prefixLen, prefixLen, payload, n, err)
+			}
+
+			if _, err := WriteFrame(&buf, []byte("a very long message"), prefixLen, order, 8); err != ErrPacketTooLong {
+				t.Errorf("prefix[%v]: ErrPacketTooLong expected for write, got %v", prefixLen, err)
+			}
+			if _, n, err := ReadFrame(frames, prefixLen, order, 4); err != ErrPacketTooLong || n != len(frames) {
+				t.Errorf("prefix[%v]: (nil, %v, ErrPacketTooLong) expected for read, got (%v, %v)", prefixLen, len(frames), n, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package xtcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	errProxyHeader = errors.New("xtcp.proxy: malformed PROXY protocol header")
+)
+
+// proxyHeaderMaxLen is the max length of PROXY protocol v1 header include the "\r\n".
+const proxyHeaderMaxLen = 107
+
+// readProxyHeader read and parse the PROXY protocol v1 header from conn, eg:
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+// It reads byte by byte, so no data after the header will be consumed.
+// return the source address of the header, nil if the protocol is UNKNOWN.
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	var header [proxyHeaderMaxLen]byte
+	n := 0
+	for {
+		if n == len(header) {
+			return nil, errProxyHeader
+		}
+		if _, err := conn.Read(header[n : n+1]); err != nil {
+			return nil, err
+		}
+		n++
+		if n >= 2 && header[n-2] == '\r' && header[n-1] == '\n' {
+			break
+		}
+	}
+	return parseProxyHeader(header[:n-2])
+}
+
+// parseProxyHeader parse the PROXY protocol v1 header line without "\r\n".
+func parseProxyHeader(line []byte) (net.Addr, error) {
+	if !bytes.HasPrefix(line, []byte("PROXY ")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(string(line), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the receiver must ignore anything after UNKNOWN.
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, errProxyHeader
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, errProxyHeader
+		}
+	case "TCP6":
+		if ip.To4() != nil {
+			return nil, errProxyHeader
+		}
+	default:
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,94 @@
+package xtcp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string
+		ok     bool
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n", "", false},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 port 443\r\n", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+	}
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(test.header + "data"))
+			client.Close()
+		}()
+		addr, err := readProxyHeader(server)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: error expected", test.header)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: read err : %v", test.header, err)
+		} else if (addr == nil && test.addr != "") || (addr != nil && addr.String() != test.addr) {
+			t.Errorf("%q: %v expected, got %v", test.header, test.addr, addr)
+		}
+		// the data after header should not be consumed.
+		if data, _ := io.ReadAll(server); string(data) != "data" {
+			t.Errorf("%q: 'data' expected after header, got %q", test.header, data)
+		}
+		server.Close()
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	addrs := make(chan net.Addr, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			addrs <- c.RemoteAddr()
+		}
+	}), &myProtocol{}).SetEnableProxyProtocol(true))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer raw.Close()
+	buf, _ := (&myProtocol{}).Pack(&myPacket{msg: "hello"})
+	raw.Write(append([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 443\r\n"), buf...))
+	select {
+	case addr := <-addrs:
+		if addr.String() != "10.1.2.3:40000" {
+			t.Errorf("10.1.2.3:40000 expected, got %v", addr)
+		}
+	case <-time.After(time.Second):
+		t.Error("packet after PROXY header expected to be received")
+	}
+
+	// malformed header should close the conn.
+	bad, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer bad.Close()
+	bad.Write([]byte("HELLO\r\n"))
+	bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("EOF expected for malformed header, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package xtcp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReconnectAttempts means that ReconnectConn stopped reconnecting after MaxAttempts.
+	ErrReconnectAttempts = errors.New("xtcp.ReconnectConn: max reconnect attempts reached")
+)
+
+// BackoffFunc return the duration to wait before the attempt-th reconnect, attempt starts from 1.
+type BackoffFunc func(attempt int) time.Duration
+
+// ExponentialBackoff return a BackoffFunc which doubles the wait from min for each attempt up to max,
+// with a random jitter of half the wait, so the clients will not reconnect at the same time.
+func ExponentialBackoff(min, max time.Duration) BackoffFunc {
+	if min <= 0 || max < min {
+		panic("xtcp.ExponentialBackoff: invalid min or max")
+	}
+	return func(attempt int) time.Duration {
+		d := max
+		if attempt < 32 {
+			if e := min << uint(attempt-1); e > 0 && e < max {
+				d = e
+			}
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
+
+// ReconnectConn is a client conn which redials the addr with backoff when disconnected, until Stop called.
+// Each connection is a new Conn with the same Options, so the Handler will receive
+// EventConnected and EventClosed of each connection.
+type ReconnectConn struct {
+	Opts    *Options
+	Addr    string
+	Backoff BackoffFunc
+
+	// MaxAttempts is the max number of reconnect attempts since the last connected, 0 mean no limit.
+	// Serve returns ErrReconnectAttempts when reached.
+	MaxAttempts int
+	// MaxBackoff caps the wait returned by Backoff, 0 mean no cap.
+	MaxBackoff time.Duration
+	// OnReconnect is called in the Serve goroutine before waiting for the attempt-th reconnect,
+	// err is the dial error, or the last error of the closed conn, nil if it closed without error.
+	OnReconnect func(attempt int, err error)
+
+	mu       sync.Mutex
+	conn     *Conn // the connected conn, nil if disconnected.
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopMode StopMode
+	done     chan struct{}
+	cancel   context.CancelFunc // cancel the context of the last DialAndServeContext, protected by mu.
+}
+
+// NewReconnectConn create a ReconnectConn but not connect, call Serve to start.
+// backoff nil mean ExponentialBackoff(100ms, 30s).
+func NewReconnectConn(opts *Options, addr string, backoff BackoffFunc) *ReconnectConn {
+	if backoff == nil {
+		backoff = ExponentialBackoff(100*time.Millisecond, 30*time.Second)
+	}
+	return &ReconnectConn{
+		Opts:    opts,
+		Addr:    addr,
+		Backoff: backoff,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve connects to the addr and serve, redials if disconnected or failed to dial.
+// It blocks until Stop called and the last conn closed and returns nil,
+// or returns ErrReconnectAttempts after MaxAttempts failed.
+func (rc *ReconnectConn) Serve() error {
+	defer close(rc.done)
+
+	h := &reconnectHandler{rc: rc}
+	opts := *rc.Opts
+	opts.Handler = h
+
+	attempt := 0
+	for {
+		h.connected = false
+		c := NewConn(&opts)
+		// Stop cancels it if not connected, so a hanging dial will not block it.
+		ctx, cancel := context.WithCancel(context.Background())
+		rc.mu.Lock()
+		rc.cancel = cancel
+		rc.mu.Unlock()
+		select {
+		case <-rc.stop:
+			cancel()
+		default:
+		}
+		err := c.DialAndServeContext(ctx, rc.Addr)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			logFields(rc.Opts.logger(), LogLevelError, "XTCP ReconnectConn: dial error", Field{FieldAddr, rc.Addr}, Field{FieldError, err})
+		}
+		if h.connected {
+			attempt = 0
+			err = c.LastError()
+		}
+		attempt++
+
+		select {
+		case <-rc.stop:
+			return nil
+		default:
+		}
+		if rc.MaxAttempts > 0 && attempt > rc.MaxAttempts {
+			return ErrReconnectAttempts
+		}
+		if rc.OnReconnect != nil {
+			rc.OnReconnect(attempt, err)
+		}
+		d := rc.Backoff(attempt)
+		if rc.MaxBackoff > 0 && d > rc.MaxBackoff {
+			d = rc.MaxBackoff
+		}
+
+		timer := time.NewTimer(d)
+		select {
+		case <-rc.stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// reconnectHandler track the conn of ReconnectConn, then pass the events to the Handler of ReconnectConn.
+type reconnectHandler struct {
+	rc        *ReconnectConn
+	connected bool // the last conn connected, only used in the Serve goroutine.
+}
+
+func (h *reconnectHandler) OnEvent(et EventType, c *Conn, p Packet) {
+	rc := h.rc
+	switch et {
+	case EventConnected:
+		h.connected = true
+		rc.mu.Lock()
+		rc.conn = c
+		rc.mu.Unlock()
+		select {
+		case <-rc.stop:
+			// stopped while dialing, don't wait in the handler.
+			if rc.stopMode == StopImmediately {
+				c.Stop(StopImmediately)
+			} else {
+				c.Stop(StopGracefullyButNotWait)
+			}
+		default:
+		}
+	case EventClosed:
+		rc.mu.Lock()
+		rc.conn = nil
+		rc.mu.Unlock()
+	}
+	rc.Opts.Handler.OnEvent(et, c, p)
+}
+
+// Conn return the connected conn, nil if disconnected.
+func (rc *ReconnectConn) Conn() *Conn {
+	rc.mu.Lock()
+	c := rc.conn
+	rc.mu.Unlock()
+	return c
+}
+
+// Send send the packet by the connected conn, return ErrConnClosed if disconnected.
+func (rc *ReconnectConn) Send(p Packet) error {
+	c := rc.Conn()
+	if c == nil {
+		return ErrConnClosed
+	}
+	return c.Send(p)
+}
+
+// Stop stops reconnecting permanently and stops the connected conn by mode, a pending dial is cancelled.
+// StopGracefullyAndWait and StopDrainInbound also block until Serve returns, don't use it if Serve not called.
+// It is safe to call Stop more than once, only the first call works.
+func (rc *ReconnectConn) Stop(mode StopMode) {
+	first := false
+	rc.stopOnce.Do(func() {
+		first = true
+		rc.mu.Lock()
+		rc.stopMode = mode
+		close(rc.stop)
+		c := rc.conn
+		if c == nil && rc.cancel != nil {
+			// dialing or waiting to reconnect, a conn dialed but not fired EventConnected yet
+			// is stopped immediately, nothing can be sent to it before that.
+			rc.cancel()
+		}
+		rc.mu.Unlock()
+		if c != nil {
+			m := mode
+			if m == StopGracefullyAndWait {
+				m = StopGracefullyButNotWait
+			}
+			c.Stop(m)
+		}
+	})
+	if first && (mode == StopGracefullyAndWait || mode == StopDrainInbound) {
+		<-rc.done
+	}
+}
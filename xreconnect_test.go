@@ -0,0 +1,183 @@
+package xtcp
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(10*time.Millisecond, 100*time.Millisecond)
+	for attempt, max := range []time.Duration{0, 10, 20, 40, 80, 100, 100} {
+		if attempt == 0 {
+			continue
+		}
+		max *= time.Millisecond
+		if d := backoff(attempt); d < max/2 || d > max {
+			t.Errorf("attempt[%v]: [%v, %v] expected, got %v", attempt, max/2, max, d)
+		}
+	}
+	if d := backoff(1000); d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("attempt[1000]: [50ms, 100ms] expected, got %v", d)
+	}
+}
+
+func TestReconnectConn(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			// kick the client, it should reconnect.
+			c.Stop(StopImmediately)
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	events := make(chan EventType, 100)
+	rc := NewReconnectConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventConnected || et == EventClosed {
+			events <- et
+		}
+	}), p), l.Addr().String(), func(attempt int) time.Duration { return time.Millisecond })
+	served := make(chan struct{})
+	go func() {
+		rc.Serve()
+		close(served)
+	}()
+
+	for i := 0; i < 3; i++ {
+		if et := <-events; et != EventConnected {
+			t.Errorf("%v: EventConnected expected, got %v", i, et)
+		}
+		if et := <-events; et != EventClosed {
+			t.Errorf("%v: EventClosed expected, got %v", i, et)
+		}
+	}
+	rc.Stop(StopImmediately)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Error("Serve expected to return after Stop")
+	}
+	if err := rc.Send(&myPacket{msg: "closed"}); err != ErrConnClosed {
+		t.Errorf("ErrConnClosed expected after stop, got %v", err)
+	}
+}
+
+func TestReconnectAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	addr := l.Addr().String()
+	l.Close() // nothing listening, every dial fails.
+
+	var attempts []int
+	rc := NewReconnectConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}),
+		addr, func(attempt int) time.Duration { return time.Hour })
+	rc.MaxAttempts = 3
+	rc.MaxBackoff = time.Millisecond
+	rc.OnReconnect = func(attempt int, err error) {
+		if err == nil {
+			t.Errorf("attempt[%v]: dial error expected", attempt)
+		}
+		attempts = append(attempts, attempt)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- rc.Serve()
+	}()
+	select {
+	case err := <-served:
+		if err != ErrReconnectAttempts {
+			t.Errorf("ErrReconnectAttempts expected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve expected to return after max attempts, the backoff should be capped")
+		rc.Stop(StopImmediately)
+		<-served
+	}
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Errorf("[1 2 3] attempts expected, got %v", attempts)
+	}
+}
+
+func TestReconnectStopDialing(t *testing.T) {
+	dialing := make(chan struct{}, 1)
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{})
+	// the dial hangs until its context done, eg: a blackholed address.
+	opts.Dialer = &net.Dialer{ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		dialing <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	rc := NewReconnectConn(opts, "127.0.0.1:1", nil)
+	served := make(chan error, 1)
+	go func() {
+		served <- rc.Serve()
+	}()
+	<-dialing
+
+	stopped := make(chan struct{})
+	go func() {
+		rc.Stop(StopGracefullyAndWait)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop expected to cancel the hanging dial")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("nil expected from Serve, got %v", err)
+	}
+}
+
+func TestReconnectAttemptsStopDialing(t *testing.T) {
+	dials := make(chan struct{}, 2)
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{})
+	// the first dial fails, the second hangs until its context done.
+	opts.Dialer = &net.Dialer{ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		dials <- struct{}{}
+		if len(dials) == 1 {
+			return syscall.ECONNREFUSED
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	var attempts []int
+	rc := NewReconnectConn(opts, "127.0.0.1:1", func(attempt int) time.Duration { return time.Millisecond })
+	rc.MaxAttempts = 1
+	rc.OnReconnect = func(attempt int, err error) {
+		attempts = append(attempts, attempt)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- rc.Serve()
+	}()
+	for len(dials) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rc.Stop(StopGracefullyButNotWait)
+	select {
+	case err := <-served:
+		// stopped, not reached MaxAttempts by the cancelled dial.
+		if err != nil {
+			t.Errorf("nil expected from Serve, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve expected to return after Stop cancelled the hanging dial")
+	}
+	if len(attempts) != 1 {
+		t.Errorf("OnReconnect expected to be called once before Stop, got %v", attempts)
+	}
+}
@@ -0,0 +1,30 @@
+package xtcp
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrReusePortUnsupported means that SO_REUSEPORT is not supported on the platform.
+var ErrReusePortUnsupported = errors.New("xtcp.server: SO_REUSEPORT is not supported on this platform")
+
+// ListenReusePort listens on the TCP network address addr with SO_REUSEPORT,
+// so several servers (or processes) can listen on the same port and the kernel
+// distributes the incoming conns among them, eg:
+//
+//	for i := 0; i < runtime.NumCPU(); i++ {
+//		l, err := xtcp.ListenReusePort(":8080")
+//		...
+//		go xtcp.NewServer(opts).Serve(l)
+//	}
+//
+// It is supported on Linux and BSDs (include macOS),
+// return ErrReusePortUnsupported on other platforms.
+func ListenReusePort(addr string) (net.Listener, error) {
+	if reusePortControl == nil {
+		return nil, ErrReusePortUnsupported
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,10 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package xtcp
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
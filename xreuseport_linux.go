@@ -0,0 +1,14 @@
+package xtcp
+
+import (
+	"runtime"
+	"strings"
+)
+
+// soReusePort is the value of SO_REUSEPORT, the syscall package doesn't define it on linux.
+var soReusePort = func() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0x200
+	}
+	return 0xf
+}()
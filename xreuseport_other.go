@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package xtcp
+
+import (
+	"syscall"
+)
+
+// reusePortControl is nil because SO_REUSEPORT is not supported.
+var reusePortControl func(network, address string, c syscall.RawConn) error
@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package xtcp
+
+import (
+	"syscall"
+)
+
+// reusePortControl set SO_REUSEPORT to the socket before bind.
+var reusePortControl = func(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -1,20 +1,33 @@
 package xtcp
 
 import (
-	"github.com/xfxdev/xlog"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
 	"time"
 )
 
+var (
+	errServerStopped     = errors.New("server stopped")
+	errTooManyConns      = errors.New("too many conns")
+	errTooManyConnsPerIP = errors.New("too many conns from the ip")
+)
+
 // Server used for running a tcp server.
 type Server struct {
-	Opts  *Options
-	stop  chan struct{}
-	wg    sync.WaitGroup
-	mu    sync.Mutex
-	lis   net.Listener
-	conns map[*Conn]bool
+	Opts     *Options
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	lis      []net.Listener // the listeners serving, in the order of Serve called.
+	conns    map[*Conn]bool
+	ids      map[uint64]*Conn // the conns by id, used for ConnByID.
+	ips      map[string]int   // conn count of each ip, used for MaxConnsPerIP.
+	ctx      context.Context
+	tags     map[string]map[*Conn]bool // the conns by tag, see Conn.AddTag.
+	stopOnce sync.Once
 }
 
 // ListenAndServe listens on the TCP network address addr and then
@@ -25,69 +38,137 @@ func (s *Server) ListenAndServe(addr string) error {
 		return err
 	}
 
-	s.Serve(l)
-
-	return nil
+	return s.Serve(l)
 }
 
 // Serve start the tcp server to accept.
-func (s *Server) Serve(l net.Listener) {
+// l can be any stream listener, eg: net.Listen("unix", path) for unix domain socket,
+// the socket file will be removed when the listener closed by Stop.
+// Serve always returns a non-nil error if the accept failed,
+// return nil if the server stopped by Stop or StopAccepting.
+func (s *Server) Serve(l net.Listener) error {
+	return s.ServeContext(context.Background(), l)
+}
+
+// ServeContext is the same as Serve, but the server will be stopped
+// by Stop(StopGracefullyButNotWait) when ctx is done.
+// The contexts of accepted conns are derived from ctx.
+func (s *Server) ServeContext(ctx context.Context, l net.Listener) error {
 	defer func() {
 		s.wg.Done()
 
-		s.mu.Lock()
-		lis := s.lis
-		s.lis = nil
-		s.mu.Unlock()
-
-		if lis != nil {
-			lis.Close()
+		if s.removeListener(l) {
+			l.Close()
 		}
 	}()
 
 	s.wg.Add(1)
 
 	s.mu.Lock()
-	s.lis = l
+	select {
+	case <-s.stop:
+		// stopped before serve.
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	default:
+	}
+	s.lis = append(s.lis, l)
+	s.ctx = ctx
 	s.mu.Unlock()
 
-	xlog.Info("XTCP server: listen on: ", l.Addr().String())
+	s.log(LogLevelInfo, "XTCP server: listen", Field{FieldAddr, l.Addr()})
+
+	served := make(chan struct{})
+	defer close(served)
+	if ctx.Done() != nil {
+		// start after the listener set, so Stop can close it.
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.Stop(StopGracefullyButNotWait)
+			case <-served:
+			}
+		}()
+	}
 
 	var tempDelay time.Duration // how long to sleep on accept failure
 
+	var limiter *tokenBucket
+	if s.Opts.AcceptRateLimit > 0 {
+		limiter = newTokenBucket(s.Opts.AcceptRateLimit)
+	}
+
+	var handshakes chan struct{} // the semaphore of the conns handshaking.
+	if s.Opts.MaxConcurrentHandshakes > 0 {
+		handshakes = make(chan struct{}, s.Opts.MaxConcurrentHandshakes)
+	}
+
 	for {
-		conn, err := l.Accept()
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				xlog.Errorf("XTCP Server: Accept error: %v; retrying in %v", err, tempDelay)
+		if limiter != nil {
+			// wait for token, don't accept too fast.
+			for wait := limiter.take(time.Now()); wait > 0; wait = limiter.take(time.Now()) {
 				select {
-				case <-time.After(tempDelay):
-					continue
+				case <-time.After(wait):
 				case <-s.stop:
-					return
+					return nil
+				}
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if !s.hasListener(l) {
+				// don't report if listener closed by Stop or StopAccepting.
+				return nil
+			}
+
+			nerr, ok := err.(net.Error)
+			temporary := ok && nerr.Temporary()
+			retry := temporary
+			if s.Opts.OnAcceptError != nil {
+				retry = s.Opts.OnAcceptError(err)
+			}
+			if !retry {
+				if s.Opts.OnAcceptError == nil {
+					s.log(LogLevelError, "XTCP Server: Accept error, server closed", Field{FieldAddr, l.Addr()}, Field{FieldError, err})
 				}
+				return err
 			}
 
+			initial, max := s.Opts.acceptBackoff()
+			if tempDelay == 0 {
+				tempDelay = initial
+			} else {
+				tempDelay *= 2
+			}
+			if tempDelay > max {
+				tempDelay = max
+			}
+			if s.Opts.OnAcceptError == nil {
+				s.log(LogLevelError, "XTCP Server: Accept error, retrying", Field{FieldAddr, l.Addr()}, Field{FieldError, err}, Field{"retry_in", tempDelay})
+			}
 			select {
+			case <-time.After(tempDelay):
+				continue
 			case <-s.stop:
-				// don't log if listener closed.
-			default:
-				xlog.Errorf("XTCP Server: Accept error: %v; server closed!", err)
+				return nil
 			}
-
-			return
 		}
 
 		tempDelay = 0
-		go s.handleRawConn(conn)
+		if handshakes != nil {
+			// don't accept more until a handshaking conn done.
+			select {
+			case handshakes <- struct{}{}:
+			case <-s.stop:
+				conn.Close()
+				return nil
+			}
+		}
+		// add before the goroutine start, so Wait will not miss it after the accept loop exit.
+		s.wg.Add(1)
+		go s.handleRawConn(conn, handshakes)
 	}
 }
 
@@ -95,22 +176,86 @@ func (s *Server) Serve(l net.Listener) {
 // StopImmediately: immediately closes all open connections and listener.
 // StopGracefullyButNotWait: stops the server to accept new connections.
 // StopGracefullyAndWait: stops the server to accept new connections and blocks until all connections are closed.
+// StopDrainInbound: stops the server to accept new connections, drains all connections concurrently by
+// Conn.Stop(StopDrainInbound), and blocks until all connections are closed.
+// It is safe to call Stop more than once, only the first call works, the others return directly.
 func (s *Server) Stop(mode StopMode) {
-	close(s.stop)
+	if s.stopConns(mode) == nil {
+		return
+	}
+	if mode == StopGracefullyAndWait || mode == StopDrainInbound {
+		s.wg.Wait()
+	}
 
-	s.mu.Lock()
+	s.log(LogLevelInfo, "XTCP server stop")
+}
 
-	lis := s.lis
-	s.lis = nil
+// StopWithTimeout stops the server gracefully like Stop, but waits at most d for the conns to drain,
+// then stops the remaining conns immediately and returns the number of them.
+// If mode is StopGracefullyAndWait or StopDrainInbound, it also blocks until the remaining conns are closed.
+// StopImmediately is the same as Stop(StopImmediately) and returns 0.
+// Only the first call of Stop or StopWithTimeout works, the others return 0 directly.
+func (s *Server) StopWithTimeout(mode StopMode, d time.Duration) int {
+	conns := s.stopConns(mode)
+	if conns == nil {
+		return 0
+	}
+	forced := 0
+	if mode != StopImmediately {
+		drained := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(drained)
+		}()
+
+		timer := time.NewTimer(d)
+		select {
+		case <-drained:
+		case <-timer.C:
+			for c := range conns {
+				select {
+				case <-c.Done():
+				default:
+					forced++
+					c.Stop(StopImmediately)
+				}
+			}
+			if mode == StopGracefullyAndWait || mode == StopDrainInbound {
+				<-drained
+			}
+		}
+		timer.Stop()
+	}
 
-	conns := s.conns
-	s.conns = nil
+	s.log(LogLevelInfo, "XTCP server stop", Field{"forced", forced})
+	return forced
+}
 
-	s.mu.Unlock()
+// stopConns stops accepting and stops all the conns by mode, but don't wait.
+// return the stopped conns, nil if the server already stopped.
+func (s *Server) stopConns(mode StopMode) map[*Conn]bool {
+	first := false
+	s.stopOnce.Do(func() {
+		first = true
+		close(s.stop)
+	})
+	if !first {
+		return nil
+	}
+
+	s.StopAccepting()
 
-	if lis != nil {
-		lis.Close()
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.ids = nil
+	s.ips = nil
+	s.tags = nil
+	notify := make(map[*Conn]bool, len(conns))
+	for c := range conns {
+		notify[c] = s.markRemoved(c)
 	}
+	s.mu.Unlock()
 
 	m := mode
 	if m == StopGracefullyAndWait {
@@ -118,17 +263,188 @@ func (s *Server) Stop(mode StopMode) {
 		m = StopGracefullyButNotWait
 	}
 	for c := range conns {
-		c.Stop(m)
+		c.setCloseReason(CloseReasonServerStop)
+		if m == StopDrainInbound {
+			// drain the conns concurrently, Stop or StopWithTimeout waits them by s.wg.
+			go c.Stop(m)
+		} else {
+			c.Stop(m)
+		}
+		// the conns are removed from the server at once,
+		// except the ones OnConnAdded not returned yet, addConn calls OnConnRemoved after it.
+		if notify[c] && s.Opts.OnConnRemoved != nil {
+			s.Opts.OnConnRemoved(c)
+		}
+	}
+	return conns
+}
+
+// Wait blocks until Serve and all the conns of the server exit,
+// eg: call Stop(StopGracefullyButNotWait) first and Wait later.
+// It should be called after Serve started, otherwise it may return immediately.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Broadcast send the packet to all the conns of the server.
+// It will not block on the conns which send list is full,
+// return the conns which failed to accept the packet.
+func (s *Server) Broadcast(p Packet) []*Conn {
+	var failed []*Conn
+	// not hold the lock while sending, EventSend may be fired by SendEventOnEnqueue.
+	s.Range(func(c *Conn) bool {
+		if c.trySend(p) != nil {
+			failed = append(failed, c)
+		}
+		return true
+	})
+	return failed
+}
+
+// BroadcastRaw is the same as Broadcast, but send the pre-packed bytes by SendRaw, eg: packed once by PackOnce.
+// All the conns must use the same protocol, otherwise the bytes are invalid for some of them.
+func (s *Server) BroadcastRaw(b []byte) []*Conn {
+	return s.Broadcast(RawPacket(b))
+}
+
+// Range calls f sequentially for each conn of the server, stops if f returns false.
+// Range iterates a snapshot of the conns, so f can safely stop the conn or call other methods of the server.
+func (s *Server) Range(f func(c *Conn) bool) {
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
 	}
+	s.mu.Unlock()
 
-	if mode == StopGracefullyAndWait {
-		s.wg.Wait()
+	for _, c := range conns {
+		if !f(c) {
+			break
+		}
+	}
+}
+
+// ConnCount return the number of the active conns, 0 after the server stopped.
+func (s *Server) ConnCount() int {
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	return n
+}
+
+// ConnByID return the active conn with the id, false if not found, eg: the conn closed or the server stopped.
+func (s *Server) ConnByID(id uint64) (*Conn, bool) {
+	s.mu.Lock()
+	c, ok := s.ids[id]
+	s.mu.Unlock()
+	return c, ok
+}
+
+// Addr return the address of the listener, nil if the server is not serving,
+// eg: get the port after Serve a listener with ":0". It returns nil after Stop or StopAccepting.
+// If more than one listener serving, it return the first one, see Addrs.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.lis) == 0 {
+		return nil
+	}
+	return s.lis[0].Addr()
+}
+
+// Addrs return the addresses of all the listeners serving, in the order of Serve called.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(s.lis))
+	for _, l := range s.lis {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+// ServeAll serve all the listeners with the server, eg: a plain listener and a tls listener,
+// the conns of all listeners share the Options, the conns limit, Broadcast and Stop.
+// It blocks until all the accept loops exit. If one of them failed, the others stop accepting too,
+// and the first error is returned, return nil if the server stopped by Stop or StopAccepting.
+func (s *Server) ServeAll(listeners ...net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := s.Serve(l)
+			if err != nil {
+				s.StopAccepting()
+			}
+			errs <- err
+		}(l)
+	}
+	var first error
+	for range listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
 	}
+	return first
+}
+
+// hasListener return true if l is serving.
+func (s *Server) hasListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sl := range s.lis {
+		if sl == l {
+			return true
+		}
+	}
+	return false
+}
+
+// removeListener remove l from the serving listeners, return false if it's not serving.
+func (s *Server) removeListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sl := range s.lis {
+		if sl == l {
+			s.lis = append(s.lis[:i], s.lis[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
 
-	xlog.Info("XTCP server stop.")
+// log write the msg with fields to the logger of Opts, see FieldLogger.
+func (s *Server) log(level LogLevel, msg string, fields ...Field) {
+	logFields(s.Opts.logger(), level, msg, fields...)
 }
 
-func (s *Server) handleRawConn(conn net.Conn) {
+// StopAccepting closes the listeners to stop accepting new connections,
+// but the accepted connections keep running until they closed or Stop called.
+// It is useful for handing off the listen port to a new process.
+func (s *Server) StopAccepting() {
+	s.mu.Lock()
+	lis := s.lis
+	s.lis = nil
+	s.mu.Unlock()
+
+	for _, l := range lis {
+		l.Close()
+	}
+}
+
+// handleRawConn handshake the raw conn and serve it,
+// release the semaphore handshakes when the handshake done if it's not nil.
+func (s *Server) handleRawConn(conn net.Conn, handshakes chan struct{}) {
+	defer s.wg.Done()
+
+	handshaking := handshakes != nil
+	release := func() {
+		if handshaking {
+			handshaking = false
+			<-handshakes
+		}
+	}
+	defer release()
+
 	s.mu.Lock()
 	if s.conns == nil {
 		s.mu.Unlock()
@@ -137,42 +453,184 @@ func (s *Server) handleRawConn(conn net.Conn) {
 	}
 	s.mu.Unlock()
 
+	var deadline time.Time
+	if s.Opts.HandshakeTimeout > 0 {
+		// bound the PROXY header and tls handshake too, the rest is checked by the conn.
+		deadline = time.Now().Add(s.Opts.HandshakeTimeout)
+		conn.SetDeadline(deadline)
+	}
+
+	var proxyAddr net.Addr
+	if s.Opts.EnableProxyProtocol {
+		// the header is before any other data, include the tls handshake.
+		addr, err := readProxyHeader(conn)
+		if err != nil {
+			s.log(LogLevelError, "XTCP Server: read PROXY protocol header error", Field{FieldRemoteAddr, conn.RemoteAddr()}, Field{FieldError, err})
+			conn.Close()
+			return
+		}
+		proxyAddr = addr
+	}
+
+	if s.Opts.TLSConfig != nil {
+		conn = tls.Server(conn, s.Opts.TLSConfig)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// handshake here, so the accept loop will not be blocked by slow clients.
+		if err := tlsConn.Handshake(); err != nil {
+			s.log(LogLevelError, "XTCP Server: TLS handshake error", Field{FieldRemoteAddr, conn.RemoteAddr()}, Field{FieldError, err})
+			conn.Close()
+			return
+		}
+	}
+
+	if !deadline.IsZero() {
+		conn.SetDeadline(time.Time{})
+	}
+
+	applyTCPOpts(conn, s.Opts)
+
 	tcpConn := NewConn(s.Opts)
 	tcpConn.RawConn = conn
+	tcpConn.server = s
+	tcpConn.remoteAddr = proxyAddr
+	tcpConn.hsDeadline = deadline
+	s.mu.Lock()
+	tcpConn.setParentCtx(s.ctx)
+	s.mu.Unlock()
 
-	if !s.addConn(tcpConn) {
+	if err := s.addConn(tcpConn); err != nil {
+		if err == errTooManyConns || err == errTooManyConnsPerIP {
+			if s.Opts.OnReject != nil {
+				s.Opts.OnReject(conn)
+			} else {
+				s.log(LogLevelError, "XTCP Server: reject conn", Field{FieldRemoteAddr, conn.RemoteAddr()}, Field{FieldError, err})
+			}
+		}
 		tcpConn.Stop(StopImmediately)
 		return
 	}
 
-	defer func() {
-		s.removeConn(tcpConn)
-		s.wg.Done()
-	}()
+	defer s.removeConn(tcpConn)
 
-	s.Opts.Handler.OnEvent(EventAccept, tcpConn, nil)
+	release()
+	tcpConn.serve(EventAccept)
+}
 
-	s.wg.Add(1)
-	tcpConn.serve()
+// addConn add the conn to the server, then call Opts.OnConnAdded.
+func (s *Server) addConn(conn *Conn) error {
+	if err := s.tryAddConn(conn); err != nil {
+		return err
+	}
+	if s.Opts.OnConnAdded != nil {
+		s.Opts.OnConnAdded(conn)
+	}
+	s.mu.Lock()
+	conn.added = true
+	removed := conn.removed
+	s.mu.Unlock()
+	if removed && s.Opts.OnConnRemoved != nil {
+		// removed while OnConnAdded running, call OnConnRemoved after it, so they are in order.
+		s.Opts.OnConnRemoved(conn)
+	}
+	return nil
 }
 
-func (s *Server) addConn(conn *Conn) bool {
+// markRemoved mark the conn removed and return true if OnConnAdded of it returned,
+// otherwise OnConnRemoved is left to addConn. The lock of server must be held.
+func (s *Server) markRemoved(conn *Conn) bool {
+	conn.removed = true
+	return conn.added
+}
+
+func (s *Server) tryAddConn(conn *Conn) error {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.conns == nil {
-		s.mu.Unlock()
-		return false
+		return errServerStopped
+	}
+	if s.Opts.MaxConns > 0 && len(s.conns) >= s.Opts.MaxConns {
+		return errTooManyConns
+	}
+	if ip := connIP(conn); s.Opts.MaxConnsPerIP > 0 && ip != "" {
+		if s.ips[ip] >= s.Opts.MaxConnsPerIP {
+			return errTooManyConnsPerIP
+		}
+		s.ips[ip]++
 	}
 	s.conns[conn] = true
-	s.mu.Unlock()
-	return true
+	s.ids[conn.id] = conn
+	// the tags added before the conn added.
+	conn.mu.Lock()
+	for tag := range conn.tags {
+		s.indexTag(conn, tag)
+	}
+	conn.mu.Unlock()
+	return nil
 }
 
+// removeConn remove the conn from the server, then call Opts.OnConnRemoved if it was in the server.
 func (s *Server) removeConn(conn *Conn) {
+	removed := false
 	s.mu.Lock()
 	if s.conns != nil {
-		delete(s.conns, conn)
+		if _, ok := s.conns[conn]; ok {
+			removed = s.markRemoved(conn)
+			delete(s.conns, conn)
+			delete(s.ids, conn.id)
+			conn.mu.Lock()
+			for tag := range conn.tags {
+				s.unindexTag(conn, tag)
+			}
+			conn.mu.Unlock()
+			if ip := connIP(conn); s.Opts.MaxConnsPerIP > 0 && ip != "" {
+				if s.ips[ip]--; s.ips[ip] <= 0 {
+					delete(s.ips, ip)
+				}
+			}
+		}
 	}
 	s.mu.Unlock()
+	if removed && s.Opts.OnConnRemoved != nil {
+		s.Opts.OnConnRemoved(conn)
+	}
+}
+
+// connIP return the remote ip of the conn, "" if it is not a tcp conn, eg: unix domain socket.
+func connIP(conn *Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// tokenBucket is a simple token bucket used to limit the accept rate.
+type tokenBucket struct {
+	rate   float64 // tokens per second, also the capacity of the bucket.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take try to take a token, return 0 if succeed, otherwise return the duration to wait for next token.
+func (tb *tokenBucket) take(now time.Time) time.Duration {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
 }
 
 // NewServer create a tcp server but not start to accept.
@@ -182,6 +640,10 @@ func NewServer(opts *Options) *Server {
 		Opts:  opts,
 		stop:  make(chan struct{}),
 		conns: make(map[*Conn]bool),
+		ids:   make(map[uint64]*Conn),
+		ips:   make(map[string]int),
+		tags:  make(map[string]map[*Conn]bool),
+		ctx:   context.Background(),
 	}
 	return s
 }
@@ -0,0 +1,104 @@
+package xtcp
+
+import "sort"
+
+// AddTag attach the tag to the conn, eg: "room:42", the server conns can be found by tag with
+// Server.ConnsByTag and Server.BroadcastToTag. It is safe to call in any goroutines,
+// the tags of a server conn are removed from the index of the server when the conn removed.
+func (c *Conn) AddTag(tag string) {
+	// lock the server first, so its index is updated with the tags of the conn together.
+	s := c.server
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	c.mu.Lock()
+	if c.tags == nil {
+		c.tags = make(map[string]bool)
+	}
+	added := !c.tags[tag]
+	c.tags[tag] = true
+	c.mu.Unlock()
+	if added && s != nil && s.conns[c] {
+		s.indexTag(c, tag)
+	}
+}
+
+// RemoveTag detach the tag from the conn, do nothing if the tag is not attached.
+func (c *Conn) RemoveTag(tag string) {
+	s := c.server
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	c.mu.Lock()
+	removed := c.tags[tag]
+	delete(c.tags, tag)
+	c.mu.Unlock()
+	if removed && s != nil && s.conns[c] {
+		s.unindexTag(c, tag)
+	}
+}
+
+// HasTag return true if the tag is attached to the conn.
+func (c *Conn) HasTag(tag string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tags[tag]
+}
+
+// Tags return the sorted tags attached to the conn.
+func (c *Conn) Tags() []string {
+	c.mu.Lock()
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	c.mu.Unlock()
+	sort.Strings(tags)
+	return tags
+}
+
+// indexTag add the conn to the index of the tag, the lock of server must be held.
+func (s *Server) indexTag(c *Conn, tag string) {
+	conns := s.tags[tag]
+	if conns == nil {
+		conns = make(map[*Conn]bool)
+		s.tags[tag] = conns
+	}
+	conns[c] = true
+}
+
+// unindexTag remove the conn from the index of the tag, the lock of server must be held.
+func (s *Server) unindexTag(c *Conn, tag string) {
+	if conns := s.tags[tag]; conns != nil {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
+
+// ConnsByTag return the active conns with the tag, nil if none, eg: the members of a chat room.
+func (s *Server) ConnsByTag(tag string) []*Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []*Conn
+	for c := range s.tags[tag] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// BroadcastToTag is the same as Broadcast, but only send the packet to the conns with the tag.
+// return the conns which failed to accept the packet.
+func (s *Server) BroadcastToTag(tag string, p Packet) []*Conn {
+	var failed []*Conn
+	// not hold the lock while sending, see Broadcast.
+	for _, c := range s.ConnsByTag(tag) {
+		if c.trySend(p) != nil {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,95 @@
+package xtcp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnTags(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	p := &myProtocol{}
+	accepted := make(chan *Conn, 3)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- c
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	var clients []net.Conn
+	var conns []*Conn
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error("dial err : ", err)
+			return
+		}
+		defer client.Close()
+		clients = append(clients, client)
+		select {
+		case c := <-accepted:
+			conns = append(conns, c)
+		case <-time.After(time.Second):
+			t.Error("EventAccept expected")
+			return
+		}
+	}
+	// the accept order may differ from the dial order, match them by address.
+	for i, client := range clients {
+		for _, c := range conns {
+			if c.RemoteAddr().String() == client.LocalAddr().String() {
+				conns[i] = c
+			}
+		}
+	}
+
+	conns[0].AddTag("room:1")
+	conns[0].AddTag("room:1")
+	conns[0].AddTag("room:2")
+	conns[1].AddTag("room:1")
+	conns[2].AddTag("room:2")
+	conns[2].RemoveTag("room:2")
+	if tags := conns[0].Tags(); !reflect.DeepEqual(tags, []string{"room:1", "room:2"}) || !conns[0].HasTag("room:2") {
+		t.Errorf("[room:1 room:2] expected, got %v", tags)
+	}
+	if n := len(server.ConnsByTag("room:1")); n != 2 {
+		t.Errorf("2 conns expected in room:1, got %v", n)
+	}
+	if n := len(server.ConnsByTag("room:2")); n != 1 {
+		t.Errorf("1 conn expected in room:2, got %v", n)
+	}
+
+	if failed := server.BroadcastToTag("room:1", &myPacket{msg: "hi"}); len(failed) != 0 {
+		t.Errorf("no failed conn expected, got %v", failed)
+	}
+	for i, client := range clients {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := client.Read(make([]byte, 64))
+		if i < 2 && err != nil {
+			t.Errorf("client %v: the broadcast packet expected, got %v", i, err)
+		} else if i == 2 && err == nil {
+			t.Errorf("client %v: no packet expected without the tag", i)
+		}
+	}
+
+	// the conn is removed from the index when closed.
+	clients[1].Close()
+	for deadline := time.Now().Add(time.Second); len(server.ConnsByTag("room:1")) != 1 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if room := server.ConnsByTag("room:1"); len(room) != 1 || room[0] != conns[0] {
+		t.Errorf("only the open conn expected in room:1, got %v", room)
+	}
+
+	server.Stop(StopImmediately)
+	if room := server.ConnsByTag("room:1"); room != nil {
+		t.Errorf("no conn expected after stopped, got %v", room)
+	}
+}
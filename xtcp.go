@@ -1,8 +1,12 @@
 package xtcp
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
+	"time"
 )
 
 var (
@@ -12,6 +16,16 @@ var (
 	DefaultRecvBufInitSize = 1 << 10 // 1k
 	// DefaultRecvBufMaxSize is the default max size of recv buf.
 	DefaultRecvBufMaxSize = 4 << 10 // 4k
+	// DefaultRecvChunkSize is the default min free space of recv buf before each read.
+	DefaultRecvChunkSize = 256
+	// DefaultWriteBufLen is the default size of write buf used to coalesce the small packets.
+	DefaultWriteBufLen = 4 << 10 // 4k
+	// DefaultNoDelay is the default TCP_NODELAY option of tcp conn, same as the go default.
+	DefaultNoDelay = true
+	// DefaultAcceptBackoffInitial is the default first delay before retrying a failed accept.
+	DefaultAcceptBackoffInitial = 5 * time.Millisecond
+	// DefaultAcceptBackoffMax is the default max delay before retrying a failed accept.
+	DefaultAcceptBackoffMax = 1 * time.Second
 )
 
 // StopMode define the stop mode of server and conn.
@@ -24,8 +38,61 @@ const (
 	StopGracefullyButNotWait
 	// StopGracefullyAndWait mean stop and wait.
 	StopGracefullyAndWait
+	// StopDrainInbound mean stop reading, finish the packets already received, then stop gracefully and wait.
+	// Unlike the graceful modes which only drain the send list, no packet read from the conn is lost.
+	StopDrainInbound
 )
 
+// CloseReason is the reason why the conn closed, see Conn.CloseReason.
+type CloseReason int32
+
+const (
+	// CloseReasonNone mean the conn is not closing.
+	CloseReasonNone CloseReason = iota
+	// CloseReasonPeerClosed mean the peer closed the conn.
+	CloseReasonPeerClosed
+	// CloseReasonLocalStop mean Conn.Stop called, include by the Handler or the context canceled.
+	CloseReasonLocalStop
+	// CloseReasonReadError mean the read failed.
+	CloseReasonReadError
+	// CloseReasonWriteError mean the write failed or timeout.
+	CloseReasonWriteError
+	// CloseReasonIdleTimeout mean nothing received in IdleTimeout or HeartbeatTimeout,
+	// or a partial packet not completed in ReadTimeout.
+	CloseReasonIdleTimeout
+	// CloseReasonServerStop mean the server stopped.
+	CloseReasonServerStop
+	// CloseReasonProtocolError mean the received packet beyond MaxPacketSize or the protocol is broken.
+	CloseReasonProtocolError
+	// CloseReasonHandshakeTimeout mean the first packet not received in HandshakeTimeout.
+	CloseReasonHandshakeTimeout
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonPeerClosed:
+		return "peer closed"
+	case CloseReasonLocalStop:
+		return "local stop"
+	case CloseReasonReadError:
+		return "read error"
+	case CloseReasonWriteError:
+		return "write error"
+	case CloseReasonIdleTimeout:
+		return "idle timeout"
+	case CloseReasonServerStop:
+		return "server stop"
+	case CloseReasonProtocolError:
+		return "protocol error"
+	case CloseReasonHandshakeTimeout:
+		return "handshake timeout"
+	default:
+		return "<unknown xtcp close reason>"
+	}
+}
+
 // EventType is the conn event type.
 type EventType int
 
@@ -41,6 +108,10 @@ func (et EventType) String() string {
 		return "recv"
 	case EventClosed:
 		return "closed"
+	case EventError:
+		return "error"
+	case EventBackpressure:
+		return "backpressure"
 	default:
 		return "<unknown xtcp event>"
 	}
@@ -51,20 +122,84 @@ const (
 	EventAccept EventType = iota
 	// EventConnected mean client connected to a server.
 	EventConnected
-	// EventSend mean conn send a packet.
+	// EventSend mean conn send a packet, when it is fired depends on Options.SendEventTiming.
 	EventSend
 	// EventRecv mean conn recv a packet.
 	EventRecv
 	// EventClosed mean conn is closed.
+	// It is fired exactly once for each served conn, after both recv and send loops exited,
+	// so no EventRecv/EventSend will be fired after it. If Stop called while a handler is running,
+	// eg: a slow EventRecv, EventClosed waits for it to return, include the ones dispatched by
+	// RecvWorkerPool or RecvQueueLen, so it never runs concurrently with the other events of the conn,
+	// see Handler for the events which may overlap before it.
 	EventClosed
+	// EventError mean conn encountered an error, p will be *ErrorPacket.
+	// If the error cause the conn to close, it will be fired before EventClosed.
+	EventError
+	// EventBackpressure mean the send list of conn has been full for Options.BackpressureThreshold,
+	// eg: a slow consumer, p will be nil. It's fired again every threshold while the send list stays full.
+	EventBackpressure
+)
+
+// SendEventTiming define when EventSend is fired.
+type SendEventTiming uint8
+
+const (
+	// SendEventOnPack fire EventSend in the send loop after the packet packed and written to the write buf,
+	// or to the conn directly if the write buf disabled. It is the default.
+	SendEventOnPack SendEventTiming = iota
+	// SendEventOnEnqueue fire EventSend in the goroutine calling Send after the packet put to the send list.
+	// Note it may be fired concurrently with the other events, even EventClosed if the conn closed at the same time.
+	SendEventOnEnqueue
+	// SendEventOnWrite fire EventSend in the send loop after the packet written to the conn,
+	// eg: after the write buf flushed.
+	SendEventOnWrite
+)
+
+// SendOverflowPolicy define what Send does when the send list is full.
+type SendOverflowPolicy uint8
+
+const (
+	// SendOverflowBlock block Send until the send list has room or the conn closed. It is the default.
+	SendOverflowBlock SendOverflowPolicy = iota
+	// SendOverflowDropNewest drop the packet passed to Send and return ErrPacketDropped.
+	SendOverflowDropNewest
+	// SendOverflowDropOldest drop the oldest packets in the send list to make room, Send return nil.
+	// SendAndWait of the dropped packet returns ErrPacketDropped.
+	SendOverflowDropOldest
 )
 
 // Handler is the event callback.
-// p will be nil when event is EventAccept/EventConnected/EventClosed
+// The handlers of a conn are not fully serialized. The EventRecv are fired one by one in order, and
+// EventClosed is always the last one and never overlaps the others, except EventSend with SendEventOnEnqueue.
+// But these may run concurrently with EventRecv: EventSend and the write EventError fired by the send loop,
+// the EventError of HeartbeatTimeout and HandshakeTimeout and EventBackpressure fired by their own goroutines.
+// They are not serialized since a handler may block on the send loop, eg: SendAndWait or Send to the full
+// send list, while the send loop fires EventSend, so guard the state shared by the handlers of a conn.
+// p will be nil when event is EventAccept/EventConnected/EventClosed/EventBackpressure
+// p will be *ErrorPacket when event is EventError
 type Handler interface {
 	OnEvent(et EventType, c *Conn, p Packet)
 }
 
+// ErrorPacket is the Packet passed to Handler with EventError.
+// Err is the error encountered, eg: io.EOF, net.Error or the error returned by Protocol.
+type ErrorPacket struct {
+	Err error
+}
+
+func (p *ErrorPacket) String() string {
+	return p.Err.Error()
+}
+
+// RawPacket is the pre-packed bytes written to the conn verbatim without the Protocol, see Conn.SendRaw.
+// It is passed to Handler with EventSend.
+type RawPacket []byte
+
+func (p RawPacket) String() string {
+	return string(p)
+}
+
 // Packet is the unit of data.
 type Packet interface {
 	fmt.Stringer
@@ -84,7 +219,7 @@ type Protocol interface {
 	// The following return conditions must be implement:
 	// (nil, 0, nil) : buf size not enough for unpack one Packet.
 	// (nil, len, err) : buf size enough but error encountered.
-	// (p, len, nil) : unpack succeed.
+	// (p, len, nil) : unpack succeed, len must be > 0, otherwise the conn will be closed with ErrZeroLengthPacket.
 	Unpack(buf []byte) (Packet, int, error)
 }
 
@@ -92,9 +227,115 @@ type Protocol interface {
 type Options struct {
 	Handler         Handler
 	Protocol        Protocol
-	SendListLen     int // default is DefaultSendListLen if you don't set.
-	RecvBufInitSize int // default is DefaultRecvBufInitSize if you don't set.
-	RecvBufMaxSize  int // default is DefaultRecvBufMaxSize if you don't set.
+	SendListLen     int           // default is DefaultSendListLen if you don't set, see Conn.SetSendListLen.
+	RecvBufInitSize int           // default is DefaultRecvBufInitSize if you don't set.
+	RecvBufMaxSize  int           // default is DefaultRecvBufMaxSize if you don't set.
+	RecvChunkSize   int           // default is DefaultRecvChunkSize if you don't set, see SetRecvChunkSize.
+	TLSConfig       *tls.Config   // use tls if not nil, default is nil.
+	Dialer          *net.Dialer   // the dialer used by DialAndServe, nil mean the default net.Dialer.
+	KeepAlivePeriod time.Duration // tcp keepalive period, 0 mean use the system default.
+	NoDelay         bool          // TCP_NODELAY option, default is DefaultNoDelay.
+	Linger          *int          // SO_LINGER option in seconds, nil mean use the system default, see SetLinger.
+	IdleTimeout     time.Duration // close the conn if no data received in the duration, 0 mean never.
+	WriteTimeout    time.Duration // close the conn if a write can't complete in the duration, 0 mean never.
+	ReadTimeout     time.Duration // close the conn if a partial packet can't complete in the duration, 0 mean never.
+	WriteBufLen     int           // default is DefaultWriteBufLen if you don't set, 0 mean write directly.
+	Logger          Logger        // default is DefaultLogger if you don't set.
+	Metrics         Metrics       // default nil mean NopMetrics.
+	// HandshakeTimeout close the server conn if the first packet not received in the duration after accepted,
+	// include the PROXY header, the tls handshake and OnHandshake, 0 mean never. See SetHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// MaxPacketSize is the max size of a received packet, the conn will be closed with ErrPacketTooLong
+	// if a packet or the buffered incomplete packet beyond it, 0 mean unlimited.
+	MaxPacketSize int
+	// WriteBatch is the max number of queued packets gathered into one writev syscall, 0 mean disabled.
+	// WriteBufLen is ignored if it's enabled.
+	WriteBatch int
+	// SendEventTiming define when EventSend is fired, default is SendEventOnPack.
+	SendEventTiming SendEventTiming
+	// SendOverflowPolicy define what Send and SendPriority do when the send list is full, default is SendOverflowBlock.
+	// SendWithTimeout always waits.
+	SendOverflowPolicy SendOverflowPolicy
+	// MaxSendBytes is the max sum of the PackSize of the packets in the send list, 0 mean no limit.
+	// SendOverflowPolicy applies if it's beyond the limit. See SetMaxSendBytes.
+	MaxSendBytes int
+	// OnPanic will be called if the handler panics, v is the value passed to panic.
+	// The conn will be stopped immediately after OnPanic returns, default nil mean just log the panic.
+	OnPanic func(c *Conn, v interface{})
+	// MaxConns is the max number of conns of server, 0 mean unlimited.
+	MaxConns int
+	// MaxConnsPerIP is the max number of conns from the same ip, 0 mean unlimited.
+	// It only works for tcp conns.
+	MaxConnsPerIP int
+	// AcceptRateLimit is the max number of conns server accept per second, 0 mean unlimited.
+	AcceptRateLimit int
+	// MaxConcurrentHandshakes is the max number of accepted conns doing the handshake at the same time,
+	// server stops accepting until one of them done, 0 mean unlimited. See SetMaxConcurrentHandshakes.
+	MaxConcurrentHandshakes int
+	// OnReject will be called if server reject the conn because of MaxConns or MaxConnsPerIP.
+	// The raw conn will be closed after OnReject returns, default nil mean just log it.
+	OnReject func(raw net.Conn)
+	// OnConnAdded and OnConnRemoved will be called when a conn added to or removed from the server,
+	// eg: to maintain an external index of the conns. Unlike EventAccept and EventClosed, they follow the
+	// membership of server exactly, eg: the rejected conn never added, all the conns removed when server stopped.
+	// They are called in the goroutine of the conn or Stop, but not with the lock of server held.
+	// OnConnRemoved of a conn is always called after its OnConnAdded returned, even if Stop races with it.
+	OnConnAdded   func(c *Conn)
+	OnConnRemoved func(c *Conn)
+	// OnAcceptError will be called instead of the default logging if server failed to accept,
+	// return true to retry with backoff, false to stop serving and Serve returns the err.
+	// default nil mean log it, retry temporary errors and stop on the others.
+	OnAcceptError func(err error) (retry bool)
+	// AcceptBackoffInitial and AcceptBackoffMax bound the delay before retrying a failed accept,
+	// it starts from AcceptBackoffInitial and doubles on each failure in a row up to AcceptBackoffMax.
+	// 0 mean DefaultAcceptBackoffInitial and DefaultAcceptBackoffMax. See SetAcceptBackoff.
+	AcceptBackoffInitial time.Duration
+	AcceptBackoffMax     time.Duration
+	// EnableProxyProtocol make server read the PROXY protocol v1 header before any other data,
+	// the client address in the header will be returned by Conn.RemoteAddr.
+	// The conn with malformed header will be closed. It doesn't work with a tls listener passed to Serve,
+	// use TLSConfig instead, the header is read before the tls handshake.
+	EnableProxyProtocol bool
+	// LogConnections log each conn at info level by Logger when it's served and closed, with the conn id,
+	// the remote address and the close reason, eg: for audit. Default false.
+	LogConnections bool
+	// OnHandshake will be called before EventAccept or EventConnected, eg: to authenticate the peer.
+	// It can read and write RawConn directly, the recv loop starts only after it returns nil.
+	// If it returns an error, the conn will be closed without any event, include EventClosed.
+	OnHandshake func(c *Conn) error
+	// ProtocolSelector will be called after OnHandshake, the returned Protocol replaces Protocol for the conn,
+	// eg: select by the ALPN protocol of Conn.TLSConnectionState to serve multiple protocols on one port.
+	// nil return or nil ProtocolSelector mean use Protocol.
+	ProtocolSelector func(c *Conn) Protocol
+	// FatalPackError classify the error of packing p in the send loop, return true to close the conn,
+	// eg: the protocol is stateful and the stream is broken. nil or false mean discard the packet and
+	// continue. Either way the error is reported as a *PackError, see PackError.
+	FatalPackError func(p Packet, err error) bool
+	// HeartbeatInterval enable the application level heartbeat if > 0, default 0 mean disabled.
+	// The conn sends HeartbeatPacket if no packet sent in the interval,
+	// and checks HeartbeatTimeout on each interval.
+	HeartbeatInterval time.Duration
+	// HeartbeatPacket return the packet to send as heartbeat, nil mean only check HeartbeatTimeout.
+	HeartbeatPacket func() Packet
+	// HeartbeatTimeout close the conn with ErrHeartbeatTimeout if no data received in the duration,
+	// 0 mean never. It should be several times of HeartbeatInterval.
+	HeartbeatTimeout time.Duration
+	// BackpressureThreshold enable EventBackpressure if > 0, default 0 mean disabled. See SetBackpressureThreshold.
+	BackpressureThreshold time.Duration
+	// OnBeforeRecv will be called before each EventRecv, eg: start a tracing span.
+	// The returned context can be got by Conn.RecvCtx in the handler, and will be passed to OnAfterRecv.
+	// Return nil mean use Conn.Ctx.
+	OnBeforeRecv func(c *Conn, p Packet) context.Context
+	// OnAfterRecv will be called after each EventRecv returns, eg: end the tracing span.
+	OnAfterRecv func(ctx context.Context, c *Conn, p Packet)
+	// RecvWorkerPool is the number of workers shared by the conns using the options to dispatch EventRecv,
+	// default 0 mean dispatch in the recv loop of each conn. See SetRecvWorkerPool.
+	RecvWorkerPool int
+	// RecvQueueLen is the length of the inbound queue of each conn, the packets are dispatched by a goroutine
+	// of the conn from the queue, default 0 mean dispatch in the recv loop. See SetRecvQueueLen.
+	RecvQueueLen int
+
+	recvPool *recvWorkerPool // started by the first conn served, stopped after the last one closed, see recvPoolsMu.
 }
 
 // NewOpts create a new options and set some default value.
@@ -110,6 +351,10 @@ func NewOpts(h Handler, p Protocol) *Options {
 		SendListLen:     DefaultSendListLen,
 		RecvBufInitSize: DefaultRecvBufInitSize,
 		RecvBufMaxSize:  DefaultRecvBufMaxSize,
+		RecvChunkSize:   DefaultRecvChunkSize,
+		WriteBufLen:     DefaultWriteBufLen,
+		NoDelay:         DefaultNoDelay,
+		Logger:          DefaultLogger,
 	}
 }
 
@@ -139,3 +384,398 @@ func (opts *Options) SetRecvBufMaxSize(s int) *Options {
 	opts.RecvBufMaxSize = s
 	return opts
 }
+
+// SetRecvChunkSize set the min free space of the recv buf before each read, 0 mean DefaultRecvChunkSize.
+// The recv buf starts with RecvBufInitSize, before each read it makes sure at least
+// RecvChunkSize bytes free: the buf is reset if all bytes are unpacked, the unread bytes are
+// moved to the front if they use less than half of the buf, otherwise the buf grows to
+// 2*cap+RecvChunkSize but never beyond RecvBufMaxSize.
+// A large chunk reduces the read calls for large packets, a small one saves memory for tiny packets.
+func (opts *Options) SetRecvChunkSize(s int) *Options {
+	if s < 0 {
+		panic("xtcp.Options.SetRecvChunkSize: negative size")
+	}
+	opts.RecvChunkSize = s
+	return opts
+}
+
+// SetTLSConfig set the tls config, nil mean plaintext tcp.
+// Server will do the tls handshake for each accepted conn, client will use tls to dial.
+func (opts *Options) SetTLSConfig(config *tls.Config) *Options {
+	opts.TLSConfig = config
+	return opts
+}
+
+// SetDialer set the dialer used by DialAndServe, eg: set the socket options by d.Control, see Dial.
+func (opts *Options) SetDialer(d *net.Dialer) *Options {
+	opts.Dialer = d
+	return opts
+}
+
+// SetWriteBufLen set size of the write buf, 0 mean write each packet to the conn directly.
+// The write buf will be flushed when there is no more packet in the send list.
+func (opts *Options) SetWriteBufLen(len int) *Options {
+	if len < 0 {
+		panic("xtcp.Options.SetWriteBufLen: negative size")
+	}
+	opts.WriteBufLen = len
+	return opts
+}
+
+// SetWriteBatch set the max number of queued packets written by one writev syscall, 0 mean disabled.
+// Each packet is packed to it's own buf by Protocol.Pack, then all the bufs are written together,
+// it avoids the copy of the write buf but allocates for each packet.
+func (opts *Options) SetWriteBatch(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetWriteBatch: negative size")
+	}
+	opts.WriteBatch = n
+	return opts
+}
+
+// SetSendOverflowPolicy set what Send does when the send list is full,
+// eg: SendOverflowDropOldest for the real-time producers which prefer the latest data to stalling.
+func (opts *Options) SetSendOverflowPolicy(policy SendOverflowPolicy) *Options {
+	opts.SendOverflowPolicy = policy
+	return opts
+}
+
+// SetMaxSendBytes limit the bytes in the send list besides the number of packets, 0 mean no limit,
+// eg: a few huge packets will not balloon the memory.
+// The PackSize of each packet is counted when put to the send list, it's uncounted when the send loop take it to write.
+// If it's beyond the limit, Send follows SendOverflowPolicy, SendWithTimeout waits.
+// A packet beyond the limit itself is accepted if the send list is empty.
+func (opts *Options) SetMaxSendBytes(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetMaxSendBytes: negative size")
+	}
+	opts.MaxSendBytes = n
+	return opts
+}
+
+// SetSendEventTiming set when EventSend is fired.
+func (opts *Options) SetSendEventTiming(t SendEventTiming) *Options {
+	opts.SendEventTiming = t
+	return opts
+}
+
+// SetKeepAlivePeriod set the tcp keepalive period, 0 mean use the system default.
+func (opts *Options) SetKeepAlivePeriod(d time.Duration) *Options {
+	if d < 0 {
+		panic("xtcp.Options.SetKeepAlivePeriod: negative period")
+	}
+	opts.KeepAlivePeriod = d
+	return opts
+}
+
+// SetNoDelay set the TCP_NODELAY option.
+func (opts *Options) SetNoDelay(noDelay bool) *Options {
+	opts.NoDelay = noDelay
+	return opts
+}
+
+// SetLinger set the SO_LINGER option of the tcp conn, the same as (*net.TCPConn).SetLinger:
+// negative mean close in the background, 0 mean discard the unsent data and reset the conn on close,
+// positive mean close block up to sec seconds to send the data.
+// It only works on the data already written to the socket, a graceful Stop flush the send list to the socket
+// before close, then linger apply to it; StopImmediately give up the send list, with 0 linger
+// even the written data not acked by the peer is discarded.
+// It is ignored for the non-tcp conns, eg: unix socket.
+func (opts *Options) SetLinger(sec int) *Options {
+	opts.Linger = &sec
+	return opts
+}
+
+// SetIdleTimeout set the idle timeout of the conn, 0 mean never timeout.
+func (opts *Options) SetIdleTimeout(d time.Duration) *Options {
+	if d < 0 {
+		panic("xtcp.Options.SetIdleTimeout: negative timeout")
+	}
+	opts.IdleTimeout = d
+	return opts
+}
+
+// SetReadTimeout set the timeout to wait for the rest of a partial packet, 0 mean never timeout.
+// It resets on each successful read and closes the conn with ErrReadTimeout, unlike IdleTimeout
+// it only applies when some bytes of a packet received, the shorter one is used if both apply.
+func (opts *Options) SetReadTimeout(d time.Duration) *Options {
+	if d < 0 {
+		panic("xtcp.Options.SetReadTimeout: negative timeout")
+	}
+	opts.ReadTimeout = d
+	return opts
+}
+
+// SetHandshakeTimeout set the timeout from accepted to the first packet unpacked, 0 mean never timeout.
+// It bounds the clients connect but send nothing, eg: slow-loris, which IdleTimeout and ReadTimeout
+// don't catch if they are long or disabled. The conn is closed with ErrHandshakeTimeout and
+// CloseReasonHandshakeTimeout, or without any event if it's still in the tls handshake or OnHandshake.
+// Only the conns accepted by Server are bounded, so the Options can be shared with the client conns, which
+// may wait for the server to speak first. The tls handshake of DialAndServe is bounded by Opts.Dialer instead.
+func (opts *Options) SetHandshakeTimeout(d time.Duration) *Options {
+	if d < 0 {
+		panic("xtcp.Options.SetHandshakeTimeout: negative timeout")
+	}
+	opts.HandshakeTimeout = d
+	return opts
+}
+
+// SetWriteTimeout set the timeout of each write to the conn, 0 mean never timeout.
+func (opts *Options) SetWriteTimeout(d time.Duration) *Options {
+	if d < 0 {
+		panic("xtcp.Options.SetWriteTimeout: negative timeout")
+	}
+	opts.WriteTimeout = d
+	return opts
+}
+
+// SetOnPanic set the callback when the handler panics.
+func (opts *Options) SetOnPanic(f func(c *Conn, v interface{})) *Options {
+	opts.OnPanic = f
+	return opts
+}
+
+// SetMaxConns set the max number of conns of server, 0 mean unlimited.
+func (opts *Options) SetMaxConns(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetMaxConns: negative count")
+	}
+	opts.MaxConns = n
+	return opts
+}
+
+// SetMaxConnsPerIP set the max number of conns from the same ip, 0 mean unlimited.
+func (opts *Options) SetMaxConnsPerIP(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetMaxConnsPerIP: negative count")
+	}
+	opts.MaxConnsPerIP = n
+	return opts
+}
+
+// SetOnReject set the callback when server reject a conn.
+func (opts *Options) SetOnReject(f func(raw net.Conn)) *Options {
+	opts.OnReject = f
+	return opts
+}
+
+// SetConnHooks set the callbacks when a conn added to or removed from the server, nil mean not set.
+func (opts *Options) SetConnHooks(added, removed func(c *Conn)) *Options {
+	opts.OnConnAdded = added
+	opts.OnConnRemoved = removed
+	return opts
+}
+
+// SetOnAcceptError set the callback when server failed to accept.
+func (opts *Options) SetOnAcceptError(f func(err error) (retry bool)) *Options {
+	opts.OnAcceptError = f
+	return opts
+}
+
+// SetAcceptBackoff set the first and the max delay before retrying a failed accept, 0 mean the default,
+// eg: a shorter max to recover faster after the fd exhaustion, or a longer one to save the CPU.
+// will panic if negative, or max is less than initial.
+func (opts *Options) SetAcceptBackoff(initial, max time.Duration) *Options {
+	if initial < 0 || max < 0 {
+		panic("xtcp.Options.SetAcceptBackoff: negative delay")
+	}
+	if initial > 0 && max > 0 && max < initial {
+		panic("xtcp.Options.SetAcceptBackoff: max less than initial")
+	}
+	opts.AcceptBackoffInitial = initial
+	opts.AcceptBackoffMax = max
+	return opts
+}
+
+// SetMaxConcurrentHandshakes set the max number of accepted conns doing the handshake at the same time,
+// so accept doesn't outrun the handling and the goroutines don't spike under connection storms, 0 mean unlimited.
+// The handshake is the work before the conn served, include reading the PROXY protocol header,
+// the tls handshake and the MaxConns check, but not Options.OnHandshake.
+// The pending conns wait in the listen backlog of the system.
+func (opts *Options) SetMaxConcurrentHandshakes(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetMaxConcurrentHandshakes: negative count")
+	}
+	opts.MaxConcurrentHandshakes = n
+	return opts
+}
+
+// SetAcceptRateLimit set the max number of conns server accept per second, 0 mean unlimited.
+func (opts *Options) SetAcceptRateLimit(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetAcceptRateLimit: negative rate")
+	}
+	opts.AcceptRateLimit = n
+	return opts
+}
+
+// SetEnableProxyProtocol set whether server read the PROXY protocol v1 header.
+func (opts *Options) SetEnableProxyProtocol(enable bool) *Options {
+	opts.EnableProxyProtocol = enable
+	return opts
+}
+
+// SetLogConnections set whether log the conns when served and closed, see LogConnections.
+func (opts *Options) SetLogConnections(enable bool) *Options {
+	opts.LogConnections = enable
+	return opts
+}
+
+// SetOnHandshake set the hook called before the conn is served.
+func (opts *Options) SetOnHandshake(f func(c *Conn) error) *Options {
+	opts.OnHandshake = f
+	return opts
+}
+
+// SetProtocolSelector set the hook to select the Protocol of each conn, see ProtocolSelector.
+func (opts *Options) SetProtocolSelector(f func(c *Conn) Protocol) *Options {
+	opts.ProtocolSelector = f
+	return opts
+}
+
+// SetFatalPackError set the hook to classify the pack errors, see FatalPackError.
+func (opts *Options) SetFatalPackError(f func(p Packet, err error) bool) *Options {
+	opts.FatalPackError = f
+	return opts
+}
+
+// SetMaxPacketSize set the max size of a received packet, 0 mean unlimited.
+func (opts *Options) SetMaxPacketSize(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetMaxPacketSize: negative size")
+	}
+	opts.MaxPacketSize = n
+	return opts
+}
+
+// SetHeartbeat enable the application level heartbeat, interval 0 mean disabled.
+// p return the packet to send when the conn is idle in the interval,
+// the conn will be closed if no data received in timeout, 0 mean never.
+func (opts *Options) SetHeartbeat(interval time.Duration, p func() Packet, timeout time.Duration) *Options {
+	if interval < 0 || timeout < 0 {
+		panic("xtcp.Options.SetHeartbeat: negative duration")
+	}
+	opts.HeartbeatInterval = interval
+	opts.HeartbeatPacket = p
+	opts.HeartbeatTimeout = timeout
+	return opts
+}
+
+// SetBackpressureThreshold fire EventBackpressure when the send list stays full for d, 0 mean disabled.
+// The send list is checked every d/4 by a goroutine of the conn, so the event may be fired concurrently with
+// the other events, eg: log the slow consumer or Stop it. It never fires if SendListLen is 0.
+func (opts *Options) SetBackpressureThreshold(d time.Duration) *Options {
+	if d < 0 {
+		panic("xtcp.Options.SetBackpressureThreshold: negative threshold")
+	}
+	opts.BackpressureThreshold = d
+	return opts
+}
+
+// SetRecvHooks set the hooks called around each EventRecv, nil mean not set.
+func (opts *Options) SetRecvHooks(before func(c *Conn, p Packet) context.Context,
+	after func(ctx context.Context, c *Conn, p Packet)) *Options {
+	opts.OnBeforeRecv = before
+	opts.OnAfterRecv = after
+	return opts
+}
+
+// SetRecvWorkerPool set the number of workers to dispatch EventRecv, 0 mean dispatch in the recv loop.
+// With the pool, a slow handler will not block the recv loop, and the heavy handlers of different conns
+// can run in parallel. Each conn is pinned to one worker by its id, so the packets of a conn are still
+// handled in order, but the conns on the same worker block each other.
+// The recv loop blocks if the queue of the worker is full. EventClosed is fired after all the
+// EventRecv of the conn handled. The workers are started when the first conn served and exit after
+// the last conn using them closed, n is applied when they are started again.
+func (opts *Options) SetRecvWorkerPool(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetRecvWorkerPool: negative size")
+	}
+	opts.RecvWorkerPool = n
+	return opts
+}
+
+// SetRecvQueueLen set the length of the inbound queue of each conn, 0 mean dispatch in the recv loop.
+// With the queue, EventRecv is fired by a goroutine of the conn in order, so a slow handler will not
+// stop reading the socket until the queue is full, then the recv loop blocks and the tcp backpressure applies.
+// RecvWorkerPool is not used if the queue enabled. EventClosed is fired after the queued packets handled.
+func (opts *Options) SetRecvQueueLen(n int) *Options {
+	if n < 0 {
+		panic("xtcp.Options.SetRecvQueueLen: negative length")
+	}
+	opts.RecvQueueLen = n
+	return opts
+}
+
+// SetLogger set the logger, nil mean DefaultLogger.
+func (opts *Options) SetLogger(l Logger) *Options {
+	opts.Logger = l
+	return opts
+}
+
+// SetMetrics set the metrics hook, nil mean NopMetrics.
+func (opts *Options) SetMetrics(m Metrics) *Options {
+	opts.Metrics = m
+	return opts
+}
+
+// logger return the logger to use, DefaultLogger if not set.
+func (opts *Options) logger() Logger {
+	if opts.Logger == nil {
+		return DefaultLogger
+	}
+	return opts.Logger
+}
+
+// acceptBackoff return the first and the max delay before retrying a failed accept.
+func (opts *Options) acceptBackoff() (time.Duration, time.Duration) {
+	initial, max := opts.AcceptBackoffInitial, opts.AcceptBackoffMax
+	if initial <= 0 {
+		initial = DefaultAcceptBackoffInitial
+	}
+	if max <= 0 {
+		max = DefaultAcceptBackoffMax
+	}
+	if max < initial {
+		max = initial
+	}
+	return initial, max
+}
+
+// metrics return the metrics to use, NopMetrics if not set.
+func (opts *Options) metrics() Metrics {
+	if opts.Metrics == nil {
+		return NopMetrics
+	}
+	return opts.Metrics
+}
+
+// acquireRecvWorkers return the recv worker pool for a conn, and start it if not running,
+// nil if RecvWorkerPool is 0. The conn must call releaseRecvWorkers after all its EventRecv handled.
+func (opts *Options) acquireRecvWorkers() *recvWorkerPool {
+	if opts.RecvWorkerPool <= 0 {
+		return nil
+	}
+	recvPoolsMu.Lock()
+	defer recvPoolsMu.Unlock()
+	if opts.recvPool == nil || opts.recvPool.conns == 0 {
+		// not started, or stopped by the conns of a copy of the options.
+		opts.recvPool = newRecvWorkerPool(opts.RecvWorkerPool)
+		opts.recvPool.start()
+	}
+	opts.recvPool.conns++
+	return opts.recvPool
+}
+
+// releaseRecvWorkers release the pool acquired by a conn, the workers exit with the last conn.
+func (opts *Options) releaseRecvWorkers(wp *recvWorkerPool) {
+	recvPoolsMu.Lock()
+	defer recvPoolsMu.Unlock()
+	wp.conns--
+	if wp.conns == 0 {
+		wp.stop()
+		if opts.recvPool == wp {
+			opts.recvPool = nil
+		}
+	}
+}
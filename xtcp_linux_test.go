@@ -0,0 +1,24 @@
+package xtcp
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// keepAliveIdle return the TCP_KEEPIDLE of the conn.
+func keepAliveIdle(conn *net.TCPConn) (time.Duration, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var v int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err == nil {
+		err = serr
+	}
+	return time.Duration(v) * time.Second, err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package xtcp
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// keepAliveIdle is only supported on linux.
+func keepAliveIdle(conn *net.TCPConn) (time.Duration, error) {
+	return 0, errors.New("keepalive idle check unsupported")
+}
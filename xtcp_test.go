@@ -2,11 +2,25 @@ package xtcp
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -129,3 +143,3371 @@ func TestXTCP(t *testing.T) {
 		t.Errorf("client send (%v) != server recv (%v)", len(hc.sends), len(hs.recvs))
 	}
 }
+
+type funcHandler func(et EventType, c *Conn, p Packet)
+
+func (f funcHandler) OnEvent(et EventType, c *Conn, p Packet) {
+	f(et, c, p)
+}
+
+func TestDialAndServeContextCancel(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan struct{})
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			cancel()
+		case EventClosed:
+			if c.Ctx().Err() == nil {
+				t.Error("conn context expected to be cancelled")
+			}
+			close(closed)
+		}
+	}), p))
+	err = client.DialAndServeContext(ctx, l.Addr().String())
+	if err != nil {
+		t.Error("client dial err : ", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("EventClosed expected after context cancelled")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p)).DialAndServeContext(ctx, l.Addr().String())
+	if err == nil {
+		t.Error("dial with cancelled context should fail")
+	}
+}
+
+func TestSendWithTimeout(t *testing.T) {
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).SetSendListLen(1)
+	c := NewConn(opts)
+	if c.LocalAddr() != nil || c.RemoteAddr() != nil {
+		t.Error("nil addr expected for unconnected conn")
+	}
+	if next := NewConn(opts); next.GetID() <= c.GetID() {
+		t.Errorf("increasing conn id expected, got %v after %v", next.GetID(), c.GetID())
+	}
+	// the conn is not serving, so nobody takes packets from the send list.
+	if err := c.SendWithTimeout(&myPacket{msg: "1"}, 10*time.Millisecond); err != nil {
+		t.Error("send to empty send list err : ", err)
+	}
+	if c.SendQueueLen() != 1 || c.SendQueueCap() != 1 {
+		t.Errorf("send queue len/cap 1/1 expected, got %v/%v", c.SendQueueLen(), c.SendQueueCap())
+	}
+	if err := c.SendWithTimeout(&myPacket{msg: "2"}, 10*time.Millisecond); err != ErrSendTimeout {
+		t.Errorf("'ErrSendTimeout' expected, got %v", err)
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	p := &myProtocol{}
+	closed := make(chan interface{}, 1)
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventClosed {
+			closed <- c.Context()
+		}
+	}), p))
+	if v := c.Context(); v != nil {
+		t.Errorf("nil context expected, got %v", v)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.SetContext(i)
+				if v, ok := c.Context().(int); !ok || v < 0 || v >= 4 {
+					t.Errorf("one of the set contexts expected, got %v", c.Context())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.SetContext("session")
+
+	server, client := net.Pipe()
+	c.RawConn = server
+	go c.serve(EventAccept)
+	client.Close()
+	select {
+	case v := <-closed:
+		if v != "session" {
+			t.Errorf("the context expected in EventClosed, got %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("EventClosed expected")
+	}
+	<-c.Done()
+	if v := c.Context(); v != nil {
+		t.Errorf("the context expected to be cleared after closed, got %v", v)
+	}
+}
+
+func TestSendListLen(t *testing.T) {
+	p := &myProtocol{}
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p).SetSendListLen(1)
+	c := NewConnWithSendListLen(opts, 3)
+	if c.SendQueueCap() != 3 {
+		t.Errorf("send queue cap 3 expected, got %v", c.SendQueueCap())
+	}
+	c.Send(&myPacket{msg: "1"})
+	c.Send(&myPacket{msg: "2"})
+	// raised to hold the queued packets.
+	if err := c.SetSendListLen(1); err != nil || c.SendQueueCap() != 2 || c.SendQueueLen() != 2 {
+		t.Errorf("send queue len/cap 2/2 expected, got %v/%v, err : %v", c.SendQueueLen(), c.SendQueueCap(), err)
+	}
+
+	// replaced while a send is blocked on the full list and more are waiting, none is lost.
+	sp, cp := net.Pipe()
+	bc := NewConn(opts)
+	bc.RawConn = sp
+	bc.Send(&myPacket{msg: "s0"})
+	sent := make(chan error, 5)
+	go func() { sent <- bc.SendWithTimeout(&myPacket{msg: "st"}, 100*time.Millisecond) }()
+	time.Sleep(20 * time.Millisecond)
+	set := make(chan error, 1)
+	go func() { set <- bc.SetSendListLen(8) }()
+	time.Sleep(20 * time.Millisecond)
+	for i := 1; i <= 4; i++ {
+		go func(i int) { sent <- bc.Send(&myPacket{msg: fmt.Sprintf("s%d", i)}) }(i)
+	}
+	select {
+	case err := <-set:
+		if err != nil {
+			t.Errorf("set send list len err : %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("SetSendListLen blocked")
+	}
+	go bc.serve(EventAccept)
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-sent:
+			if err != nil && !(err == ErrSendTimeout && i == 0) {
+				t.Errorf("send err : %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("send blocked")
+		}
+	}
+	// s0 to s4, 6 bytes each.
+	cp.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(cp, make([]byte, 5*6)); err != nil {
+		t.Errorf("5 packets expected, read err : %v", err)
+	}
+	go io.Copy(io.Discard, cp)
+	bc.Stop(StopGracefullyAndWait)
+	cp.Close()
+
+	// racing with serve, the send loop must see the list set before served.
+	sp, cp = net.Pipe()
+	rc := NewConn(opts)
+	rc.RawConn = sp
+	set = make(chan error, 1)
+	go func(rc *Conn) {
+		var err error
+		for i := 2; err == nil && i < 1000; i++ {
+			err = rc.SetSendListLen(i)
+		}
+		set <- err
+	}(rc)
+	go rc.serve(EventAccept)
+	if err := <-set; err != nil && err != ErrConnServing {
+		t.Errorf("nil or ErrConnServing expected, got %v", err)
+	}
+	if err := rc.Send(&myPacket{msg: "race"}); err != nil {
+		t.Errorf("send err : %v", err)
+	}
+	// the send loop is running once the peer got data.
+	if _, err := cp.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read err : %v", err)
+	}
+	go io.Copy(io.Discard, cp)
+	rc.Stop(StopGracefullyAndWait)
+	cp.Close()
+
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	caps := make(chan int, 1)
+	errs := make(chan error, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			caps <- c.SendQueueCap()
+			errs <- c.SetSendListLen(8)
+		}
+	}), p).SetConnHooks(func(c *Conn) { c.SetSendListLen(32) }, nil))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer client.Close()
+	select {
+	case n := <-caps:
+		if n != 32 {
+			t.Errorf("send queue cap 32 set in OnConnAdded expected, got %v", n)
+		}
+		if err := <-errs; err != ErrConnServing {
+			t.Errorf("ErrConnServing expected after served, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("EventAccept expected")
+	}
+}
+
+func TestStopGracefullyFlush(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	serving := make(chan *Conn, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			serving <- c
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	const count = 10
+	go func() {
+		c := <-serving
+		for i := 0; i < count; i++ {
+			c.Send(&myPacket{msg: "flush"})
+		}
+		c.Stop(StopGracefullyAndWait)
+	}()
+
+	recvs := 0
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			c.Send(&myPacket{msg: "start"})
+		case EventRecv:
+			recvs++
+		}
+	}), p))
+	// client will stop after server closed the conn.
+	err = client.DialAndServe(l.Addr().String())
+	if err != nil {
+		t.Error("client dial err : ", err)
+	}
+	if recvs != count {
+		t.Errorf("%v packets expected, got %v", count, recvs)
+	}
+	if stats := client.Stats(); stats.PacketsRecv != count || stats.PacketsSent != 1 {
+		t.Errorf("%v/1 packets recv/sent expected, got %v/%v", count, stats.PacketsRecv, stats.PacketsSent)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	h := funcHandler(func(et EventType, c *Conn, p Packet) {})
+	server := NewServer(NewOpts(h, &myProtocol{}))
+	ok := NewConn(NewOpts(h, &myProtocol{}).SetSendListLen(1))
+	full := NewConn(NewOpts(h, &myProtocol{}).SetSendListLen(0))
+	server.addConn(ok)
+	server.addConn(full)
+	if server.ConnCount() != 2 {
+		t.Errorf("2 conns expected, got %v", server.ConnCount())
+	}
+
+	failed := server.Broadcast(&myPacket{msg: "broadcast"})
+	if len(failed) != 1 || failed[0] != full {
+		t.Errorf("only the full conn expected to fail, got %v", failed)
+	}
+	if ok.SendQueueLen() != 1 {
+		t.Errorf("1 packet expected in send list, got %v", ok.SendQueueLen())
+	}
+
+	raw, err := PackOnce(&myPacket{msg: "raw"}, &myProtocol{})
+	if err != nil {
+		t.Error("pack once err : ", err)
+	}
+	<-ok.sendPackets
+	failed = server.BroadcastRaw(raw)
+	if len(failed) != 1 || failed[0] != full {
+		t.Errorf("only the full conn expected to fail, got %v", failed)
+	}
+	if p, _ := (<-ok.sendPackets).(RawPacket); !bytes.Equal(p, raw) {
+		t.Errorf("RawPacket %q expected in send list, got %q", raw, p)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	timeout := make(chan bool, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventError {
+			nerr, ok := p.(*ErrorPacket).Err.(net.Error)
+			timeout <- ok && nerr.Timeout()
+		}
+	}), p).SetIdleTimeout(50 * time.Millisecond))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	done := make(chan struct{})
+	go func() {
+		// the client send nothing, it will be closed by the server.
+		client.DialAndServe(l.Addr().String())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("idle conn expected to be closed by server")
+		client.Stop(StopImmediately)
+	}
+	if !<-timeout {
+		t.Error("timeout error expected with EventError")
+	}
+}
+
+// zeroLenProtocol unpack a packet from any bytes but never consume them.
+type zeroLenProtocol struct {
+	myProtocol
+}
+
+func (zp *zeroLenProtocol) Unpack(buf []byte) (Packet, int, error) {
+	return &myPacket{msg: "zero"}, 0, nil
+}
+
+// badPackProtocol failed to pack the packet "bad".
+type badPackProtocol struct {
+	myProtocol
+}
+
+var errBadPack = errors.New("bad packet")
+
+func (bp *badPackProtocol) PackTo(p Packet, w io.Writer) (int, error) {
+	if p.String() == "bad" {
+		return 0, errBadPack
+	}
+	return bp.myProtocol.PackTo(p, w)
+}
+
+func (bp *badPackProtocol) Pack(p Packet) ([]byte, error) {
+	if p.String() == "bad" {
+		return nil, errBadPack
+	}
+	return bp.myProtocol.Pack(p)
+}
+
+func TestPackError(t *testing.T) {
+	for _, batch := range []int{0, 4} {
+		for _, fatal := range []bool{false, true} {
+			errs := make(chan error, 1)
+			c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+				if et == EventError {
+					errs <- p.(*ErrorPacket).Err
+				}
+			}), &badPackProtocol{}).SetWriteBatch(batch).SetFatalPackError(func(p Packet, err error) bool {
+				return fatal
+			}))
+			server, client := net.Pipe()
+			c.RawConn = server
+			go c.serve(EventAccept)
+
+			err := c.SendAndWait(&myPacket{msg: "bad"})
+			var perr *PackError
+			if !errors.As(err, &perr) || perr.Packet.String() != "bad" || !errors.Is(err, errBadPack) {
+				t.Errorf("batch[%v] fatal[%v]: *PackError of the bad packet expected, got %v", batch, fatal, err)
+			}
+			if err := <-errs; !errors.Is(err, errBadPack) || err != c.LastError() {
+				t.Errorf("batch[%v] fatal[%v]: EventError of the pack error expected, got %v", batch, fatal, err)
+			}
+
+			if fatal {
+				select {
+				case <-c.Done():
+				case <-time.After(time.Second):
+					t.Errorf("batch[%v]: conn expected to close on the fatal pack error", batch)
+				}
+				if r := c.CloseReason(); r != CloseReasonProtocolError {
+					t.Errorf("batch[%v]: CloseReasonProtocolError expected, got %v", batch, r)
+				}
+			} else {
+				// the bad packet is discarded, the conn keeps running.
+				c.Send(&myPacket{msg: "good"})
+				expected, _ := (&myProtocol{}).Pack(&myPacket{msg: "good"})
+				buf := make([]byte, len(expected))
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := io.ReadFull(client, buf); err != nil || !bytes.Equal(buf, expected) {
+					t.Errorf("batch[%v]: the good packet expected after the bad one, got %q, %v", batch, buf, err)
+				}
+				c.Stop(StopImmediately)
+			}
+			client.Close()
+		}
+	}
+}
+
+func TestZeroLengthPacket(t *testing.T) {
+	server, client := net.Pipe()
+	errs := make(chan error, 1)
+	recvs := 0
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventRecv:
+			recvs++
+		case EventError:
+			errs <- p.(*ErrorPacket).Err
+		}
+	}), &zeroLenProtocol{}))
+	c.RawConn = server
+	go c.serve(EventAccept)
+
+	client.Write([]byte("data"))
+	select {
+	case err := <-errs:
+		if err != ErrZeroLengthPacket {
+			t.Errorf("ErrZeroLengthPacket expected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("conn expected to be closed by ErrZeroLengthPacket")
+	}
+	<-c.Done()
+	if recvs != 0 {
+		t.Errorf("no EventRecv expected, got %v", recvs)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	p := &myProtocol{}
+	tests := []struct {
+		name     string
+		opts     func(opts *Options)
+		close    func(c *Conn, client net.Conn)
+		expected CloseReason
+	}{
+		{"peer", nil, func(c *Conn, client net.Conn) { client.Close() }, CloseReasonPeerClosed},
+		{"local", nil, func(c *Conn, client net.Conn) { c.Stop(StopGracefullyButNotWait) }, CloseReasonLocalStop},
+		{"idle", func(opts *Options) { opts.SetIdleTimeout(20 * time.Millisecond) }, func(c *Conn, client net.Conn) {}, CloseReasonIdleTimeout},
+		{"protocol", func(opts *Options) { opts.SetMaxPacketSize(8) }, func(c *Conn, client net.Conn) {
+			buf, _ := p.Pack(&myPacket{msg: "too long packet"})
+			client.Write(buf)
+		}, CloseReasonProtocolError},
+	}
+	for _, test := range tests {
+		server, client := net.Pipe()
+		reasons := make(chan CloseReason, 1)
+		opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			switch et {
+			case EventError:
+				// the first reason wins.
+				c.Stop(StopImmediately)
+			case EventClosed:
+				reasons <- c.CloseReason()
+			}
+		}), p)
+		if test.opts != nil {
+			test.opts(opts)
+		}
+		c := NewConn(opts)
+		if r := c.CloseReason(); r != CloseReasonNone {
+			t.Errorf("%v: CloseReasonNone expected before closed, got %v", test.name, r)
+		}
+		c.RawConn = server
+		go c.serve(EventAccept)
+		go io.Copy(io.Discard, client)
+		test.close(c, client)
+		if r := <-reasons; r != test.expected {
+			t.Errorf("%v: %v expected, got %v", test.name, test.expected, r)
+		}
+		client.Close()
+	}
+
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	accepted := make(chan struct{})
+	reasons := make(chan CloseReason, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventAccept:
+			close(accepted)
+		case EventClosed:
+			reasons <- c.CloseReason()
+		}
+	}), p))
+	go server.Serve(l)
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer raw.Close()
+	<-accepted
+	server.Stop(StopGracefullyAndWait)
+	if r := <-reasons; r != CloseReasonServerStop {
+		t.Errorf("server: %v expected, got %v", CloseReasonServerStop, r)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	p := &myProtocol{}
+	server, client := net.Pipe()
+	errs := make(chan error, 1)
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventError {
+			errs <- p.(*ErrorPacket).Err
+		}
+	}), p).SetReadTimeout(50 * time.Millisecond).SetIdleTimeout(time.Second))
+	c.RawConn = server
+	go c.serve(EventAccept)
+	defer c.Stop(StopImmediately)
+
+	// no partial packet, only the IdleTimeout applies.
+	buf, _ := p.Pack(&myPacket{msg: "hello"})
+	client.Write(buf)
+	select {
+	case err := <-errs:
+		t.Errorf("no error expected without partial packet, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	client.Write(buf[:len(buf)-1])
+	select {
+	case err := <-errs:
+		if err != ErrReadTimeout {
+			t.Errorf("ErrReadTimeout expected, got %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("conn expected to be closed by read timeout")
+	}
+}
+
+func TestSendBeforeStopInHandler(t *testing.T) {
+	p := &myProtocol{}
+	for _, test := range []struct{ batch, workers int }{{0, 0}, {4, 0}, {0, 2}} {
+		l, err := net.Listen("tcp", ":")
+		if err != nil {
+			t.Error("listen err : ", err)
+			return
+		}
+		server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if et == EventRecv {
+				for i := 0; i < 10; i++ {
+					c.Send(&myPacket{msg: fmt.Sprintf("reply%v", i)})
+				}
+				c.Send(&myPacket{msg: "bye"})
+				c.Stop(StopGracefullyButNotWait)
+			}
+		}), p).SetWriteBatch(test.batch).SetRecvWorkerPool(test.workers))
+		go server.Serve(l)
+
+		raw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error("dial err : ", err)
+			server.Stop(StopImmediately)
+			return
+		}
+		buf, _ := p.Pack(&myPacket{msg: "hello"})
+		raw.Write(buf)
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		data, err := io.ReadAll(raw)
+		if err != nil {
+			t.Errorf("%+v: read until EOF expected, got %v", test, err)
+		}
+		var last Packet
+		for len(data) > 0 {
+			p, n, _ := p.Unpack(data)
+			if p == nil {
+				break
+			}
+			last, data = p, data[n:]
+		}
+		if last == nil || last.String() != "bye" || len(data) != 0 {
+			t.Errorf("%+v: the final packet expected to be received, got %v, rest %q", test, last, data)
+		}
+		raw.Close()
+		server.Stop(StopImmediately)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	big := &myPacket{msg: strings.Repeat("x", 1000)}
+	timeout := make(chan bool, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventAccept:
+			go func() {
+				for c.Send(big) == nil {
+				}
+			}()
+		case EventError:
+			nerr, ok := p.(*ErrorPacket).Err.(net.Error)
+			timeout <- ok && nerr.Timeout()
+		}
+	}), p).SetWriteTimeout(50 * time.Millisecond))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	// the raw conn never read, so the server can't write.
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer raw.Close()
+	select {
+	case ok := <-timeout:
+		if !ok {
+			t.Error("timeout error expected with EventError")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("conn expected to be closed by write timeout")
+	}
+}
+
+func TestOnHandshake(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	errBadToken := errors.New("bad token")
+	accepted := make(chan struct{}, 2)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- struct{}{}
+		}
+	}), p).SetOnHandshake(func(c *Conn) error {
+		token := make([]byte, 4)
+		if _, err := io.ReadFull(c.RawConn, token); err != nil {
+			return err
+		}
+		if string(token) != "good" {
+			return errBadToken
+		}
+		return nil
+	}))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	dial := func(token string) (*Conn, chan error) {
+		connected := make(chan struct{})
+		client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if et == EventConnected {
+				close(connected)
+			}
+		}), p).SetOnHandshake(func(c *Conn) error {
+			_, err := c.RawConn.Write([]byte(token))
+			return err
+		}))
+		done := make(chan error, 1)
+		go func() {
+			done <- client.DialAndServe(l.Addr().String())
+		}()
+		<-connected
+		return client, done
+	}
+
+	good, _ := dial("good")
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Error("EventAccept expected after handshake succeed")
+	}
+	good.Stop(StopImmediately)
+
+	_, done := dial("bad!")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("conn expected to be closed after handshake failed")
+	}
+	if len(accepted) != 0 {
+		t.Error("EventAccept not expected for the conn failed to handshake")
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	recvs := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventRecv:
+			recvs <- p.(*myPacket).msg
+		case EventError:
+			errs <- p.(*ErrorPacket).Err
+		}
+	}), p).SetMaxPacketSize(100))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer raw.Close()
+	small, _ := p.Pack(&myPacket{msg: "small"})
+	raw.Write(small)
+	if msg := <-recvs; msg != "small" {
+		t.Errorf("'small' expected, got %v", msg)
+	}
+
+	// claim a huge packet, the server should not wait it.
+	huge := make([]byte, 200)
+	binary.BigEndian.PutUint32(huge, 1<<30)
+	raw.Write(huge)
+	select {
+	case err := <-errs:
+		if err != ErrPacketTooLong {
+			t.Errorf("ErrPacketTooLong expected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("conn expected to be closed by MaxPacketSize")
+	}
+}
+
+func TestRecvFrameTooLong(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		protocol Protocol
+	}{
+		{"checksummed", NewChecksummedProtocol(&myProtocol{}, nil, 16)},
+		{"length prefix", NewLengthPrefixProtocol(4, binary.BigEndian, 16,
+			func(p Packet) ([]byte, error) { return []byte(p.String()), nil },
+			func(payload []byte) (Packet, error) { return &myPacket{msg: string(payload)}, nil })},
+	} {
+		var recvs int32
+		errs := make(chan error, 4)
+		closed := make(chan CloseReason, 1)
+		c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			switch et {
+			case EventRecv:
+				atomic.AddInt32(&recvs, 1)
+			case EventError:
+				errs <- p.(*ErrorPacket).Err
+			case EventClosed:
+				closed <- c.CloseReason()
+			}
+		}), test.protocol).SetRecvBufMaxSize(64 << 10))
+		server, client := net.Pipe()
+		c.RawConn = server
+		go c.serve(EventAccept)
+
+		// the payload of the oversized frame looks like valid frames, they must not be unpacked.
+		small, _ := test.protocol.Pack(&myPacket{msg: "small"})
+		var payload []byte
+		for len(payload) < 1000 {
+			payload = append(payload, small...)
+		}
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(payload)))
+		go func() {
+			// arrives across several reads.
+			client.Write(header)
+			for len(payload) > 0 {
+				n := 100
+				if n > len(payload) {
+					n = len(payload)
+				}
+				if _, err := client.Write(payload[:n]); err != nil {
+					return
+				}
+				payload = payload[n:]
+			}
+		}()
+
+		select {
+		case r := <-closed:
+			if r != CloseReasonProtocolError {
+				t.Errorf("%v: CloseReasonProtocolError expected, got %v", test.name, r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: conn expected to be closed by the oversized frame", test.name)
+		}
+		if err := <-errs; err != ErrPacketTooLong {
+			t.Errorf("%v: ErrPacketTooLong expected, got %v", test.name, err)
+		}
+		if n := atomic.LoadInt32(&recvs); n != 0 {
+			t.Errorf("%v: no packet expected from the oversized frame, got %v", test.name, n)
+		}
+		client.Close()
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	errs := make(chan error, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventError {
+			errs <- p.(*ErrorPacket).Err
+		}
+	}), p).SetHeartbeat(20*time.Millisecond, func() Packet {
+		return &myPacket{msg: "ping"}
+	}, 200*time.Millisecond))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	// the raw conn never send, so the server will close it after send some heartbeats.
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer raw.Close()
+	ping, _ := p.Pack(&myPacket{msg: "ping"})
+	buf := make([]byte, len(ping)*3)
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(raw, buf); err != nil || !bytes.Equal(buf, bytes.Repeat(ping, 3)) {
+		t.Errorf("3 heartbeats expected, got %q, err: %v", buf, err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrHeartbeatTimeout {
+			t.Errorf("ErrHeartbeatTimeout expected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("conn expected to be closed by heartbeat timeout")
+	}
+}
+
+func TestSetProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	recvs := make(chan Packet, 2)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			if p.String() == "v2" {
+				// the rest bytes should be unpacked by the new protocol.
+				c.SetProtocol(&myProtocol{})
+			}
+			recvs <- p
+		}
+	}), NewDelimiterProtocol('\n', 0)))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer raw.Close()
+	buf, _ := (&myProtocol{}).Pack(&myPacket{msg: "upgraded"})
+	raw.Write(append([]byte("v2\n"), buf...))
+	if p := <-recvs; p.String() != "v2" {
+		t.Errorf("'v2' expected, got %v", p)
+	}
+	if p, ok := (<-recvs).(*myPacket); !ok || p.msg != "upgraded" {
+		t.Errorf("'upgraded' expected by the new protocol, got %v", p)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	recvs := make(chan string, 100)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			recvs <- p.(*myPacket).msg
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	var sends int32
+	connected := make(chan struct{})
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			close(connected)
+		case EventSend:
+			atomic.AddInt32(&sends, 1)
+		}
+	}), p).SetWriteBatch(4).SetSendListLen(100))
+	go client.DialAndServe(l.Addr().String())
+	defer client.Stop(StopImmediately)
+	<-connected
+
+	for i := 0; i < 10; i++ {
+		client.Send(&myPacket{msg: fmt.Sprint(i)})
+	}
+	if err := client.SendAndWait(&myPacket{msg: "last"}); err != nil {
+		t.Error("send and wait err : ", err)
+	}
+	for i := 0; i < 10; i++ {
+		if msg := <-recvs; msg != fmt.Sprint(i) {
+			t.Errorf("%v expected, got %v", i, msg)
+		}
+	}
+	if msg := <-recvs; msg != "last" {
+		t.Errorf("'last' expected, got %v", msg)
+	}
+	if n := atomic.LoadInt32(&sends); n != 11 {
+		t.Errorf("11 EventSend expected, got %v", n)
+	}
+}
+
+func TestSendEventTiming(t *testing.T) {
+	for _, timing := range []SendEventTiming{SendEventOnPack, SendEventOnEnqueue, SendEventOnWrite} {
+		p := &myProtocol{}
+		server, client := net.Pipe()
+		sends := make(chan string, 1)
+		c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if et == EventSend {
+				sends <- p.(*myPacket).msg
+			}
+		}), p).SetSendEventTiming(timing).SetSendListLen(1))
+		c.RawConn = server
+		if timing == SendEventOnEnqueue {
+			// fired before the send loop started.
+			c.Send(&myPacket{msg: "hello"})
+			if len(sends) != 1 {
+				t.Errorf("timing[%v]: EventSend expected after enqueued", timing)
+			}
+			go c.serve(EventAccept)
+		} else {
+			go c.serve(EventAccept)
+			c.Send(&myPacket{msg: "hello"})
+		}
+
+		buf := make([]byte, 9)
+		if timing == SendEventOnWrite {
+			// the pipe is synchronous, the write can't complete before read.
+			select {
+			case <-sends:
+				t.Errorf("timing[%v]: EventSend not expected before written", timing)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		io.ReadFull(client, buf)
+		if msg := <-sends; msg != "hello" {
+			t.Errorf("timing[%v]: 'hello' expected, got %v", timing, msg)
+		}
+		c.Stop(StopImmediately)
+		<-c.Done()
+		client.Close()
+	}
+}
+
+func TestRecvHooks(t *testing.T) {
+	type ctxKey struct{}
+	p := &myProtocol{}
+	server, client := net.Pipe()
+	var calls []string
+	done := make(chan struct{})
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			calls = append(calls, "recv:"+c.RecvCtx().Value(ctxKey{}).(string))
+		}
+	}), p).SetRecvHooks(func(c *Conn, p Packet) context.Context {
+		calls = append(calls, "before")
+		return context.WithValue(c.Ctx(), ctxKey{}, p.(*myPacket).msg)
+	}, func(ctx context.Context, c *Conn, p Packet) {
+		calls = append(calls, "after:"+ctx.Value(ctxKey{}).(string))
+		close(done)
+	}))
+	c.RawConn = server
+	go c.serve(EventAccept)
+	defer c.Stop(StopImmediately)
+
+	buf, _ := p.Pack(&myPacket{msg: "span"})
+	client.Write(buf)
+	<-done
+	if expected := []string{"before", "recv:span", "after:span"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("%v expected, got %v", expected, calls)
+	}
+}
+
+func TestRecvWorkerPool(t *testing.T) {
+	p := &myProtocol{}
+	var mu sync.Mutex
+	recvs := make(map[*Conn][]string)
+	closed := make(chan []string, 2)
+	unblock := make(chan struct{})
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventRecv:
+			if p.String() == "block" {
+				<-unblock
+			}
+			mu.Lock()
+			recvs[c] = append(recvs[c], p.String())
+			mu.Unlock()
+		case EventClosed:
+			mu.Lock()
+			closed <- recvs[c]
+			mu.Unlock()
+		}
+	}), p).SetRecvWorkerPool(2)
+
+	// the ids of a and b are consecutive, so they are on different workers.
+	a, b := NewConn(opts), NewConn(opts)
+	var clients []net.Conn
+	for _, c := range []*Conn{a, b} {
+		server, client := net.Pipe()
+		c.RawConn = server
+		go c.serve(EventAccept)
+		clients = append(clients, client)
+	}
+
+	buf, _ := p.Pack(&myPacket{msg: "block"})
+	clients[0].Write(buf)
+	for _, msg := range []string{"1", "2", "3"} {
+		buf, _ := p.Pack(&myPacket{msg: msg})
+		clients[0].Write(buf)
+		clients[1].Write(buf)
+	}
+	// the handler of a is blocked, but b should not be blocked.
+	time.Sleep(time.Millisecond * 50)
+	mu.Lock()
+	if expected := []string{"1", "2", "3"}; !reflect.DeepEqual(recvs[b], expected) {
+		t.Errorf("%v expected for b, got %v", expected, recvs[b])
+	}
+	if len(recvs[a]) != 0 {
+		t.Errorf("nothing expected for a, got %v", recvs[a])
+	}
+	mu.Unlock()
+
+	// EventClosed should be fired after the pending EventRecv.
+	a.Stop(StopImmediately)
+	close(unblock)
+	if expected, got := []string{"block", "1", "2", "3"}, <-closed; !reflect.DeepEqual(got, expected) {
+		t.Errorf("%v expected for a, got %v", expected, got)
+	}
+	b.Stop(StopImmediately)
+	<-closed
+
+	// the workers exit with the last conn, and start again for the next one.
+	recvPoolsMu.Lock()
+	if opts.recvPool != nil {
+		t.Error("the recv worker pool expected to stop after the last conn closed")
+	}
+	recvPoolsMu.Unlock()
+	c := NewConn(opts)
+	server, client := net.Pipe()
+	c.RawConn = server
+	go c.serve(EventAccept)
+	clients[0].Close()
+	clients[1].Close()
+	buf, _ = p.Pack(&myPacket{msg: "again"})
+	client.Write(buf)
+	client.Close()
+	if expected, got := []string{"again"}, <-closed; !reflect.DeepEqual(got, expected) {
+		t.Errorf("%v expected after the pool restarted, got %v", expected, got)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	p := &myProtocol{}
+	serverConfig, _ := testTLSConfigs(t)
+	for _, config := range []*tls.Config{nil, serverConfig} {
+		l, err := net.Listen("tcp", "127.0.0.1:")
+		if err != nil {
+			t.Fatal("listen err : ", err)
+		}
+		reasons := make(chan CloseReason, 2)
+		errs := make(chan error, 2)
+		server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			switch et {
+			case EventError:
+				errs <- p.(*ErrorPacket).Err
+			case EventClosed:
+				reasons <- c.CloseReason()
+			}
+		}), p).SetTLSConfig(config).SetHandshakeTimeout(50 * time.Millisecond))
+		go server.Serve(l)
+
+		// connect but send nothing.
+		raw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("dial err : ", err)
+		}
+		raw.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := raw.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("tls[%v]: conn expected to be closed by the handshake timeout, got %v", config != nil, err)
+		}
+		raw.Close()
+		if config == nil {
+			if err := <-errs; err != ErrHandshakeTimeout {
+				t.Errorf("ErrHandshakeTimeout expected, got %v", err)
+			}
+			if r := <-reasons; r != CloseReasonHandshakeTimeout {
+				t.Errorf("CloseReasonHandshakeTimeout expected, got %v", r)
+			}
+
+			// the conn sent the first packet is not affected.
+			ok, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal("dial err : ", err)
+			}
+			buf, _ := p.Pack(&myPacket{msg: "hello"})
+			ok.Write(buf)
+			ok.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := ok.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("conn expected to keep running after the first packet, got %v", err)
+			}
+			ok.Close()
+		}
+		server.Stop(StopImmediately)
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	// the server accepts but never speaks.
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			raw, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer raw.Close()
+		}
+	}()
+
+	// the client conns are not bounded by the HandshakeTimeout of the shared Options.
+	conns := make(chan *Conn, 1)
+	closed := make(chan error, 2)
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			conns <- c
+		case EventError:
+			closed <- p.(*ErrorPacket).Err
+		}
+	}), &myProtocol{}).SetHandshakeTimeout(50 * time.Millisecond)
+	for _, name := range []string{"dial", "adopt"} {
+		go func() {
+			if name == "dial" {
+				NewConn(opts).DialAndServe(l.Addr().String())
+				return
+			}
+			if raw, err := net.Dial("tcp", l.Addr().String()); err == nil {
+				NewConn(opts).Adopt(raw)
+			}
+		}()
+		var c *Conn
+		select {
+		case c = <-conns:
+		case <-time.After(time.Second):
+			t.Fatalf("%v: EventConnected expected", name)
+		}
+		select {
+		case err := <-closed:
+			t.Errorf("%v: the client conn expected to keep waiting, got %v", name, err)
+		case <-time.After(150 * time.Millisecond):
+		}
+		c.Stop(StopImmediately)
+	}
+
+	// the tls handshake is bounded by the dialer timeout.
+	_, clientConfig := testTLSConfigs(t)
+	opts = NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).
+		SetTLSConfig(clientConfig).SetDialer(&net.Dialer{Timeout: 50 * time.Millisecond})
+	done := make(chan error, 1)
+	go func() { done <- NewConn(opts).DialAndServe(l.Addr().String()) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("deadline exceeded expected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the tls handshake expected to be bounded by the dialer timeout")
+	}
+}
+
+func TestRecvQueue(t *testing.T) {
+	p := &myProtocol{}
+	var recvs []string
+	closed := make(chan []string, 1)
+	unblock := make(chan struct{})
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventRecv:
+			if p.String() == "block" {
+				<-unblock
+			}
+			recvs = append(recvs, p.String())
+		case EventClosed:
+			closed <- recvs
+		}
+	}), p).SetRecvQueueLen(3))
+	server, client := net.Pipe()
+	c.RawConn = server
+	go c.serve(EventAccept)
+
+	// the pipe is synchronous, the writes complete only if the recv loop keeps reading.
+	written := make(chan struct{})
+	go func() {
+		for _, msg := range []string{"block", "1", "2", "3"} {
+			buf, _ := p.Pack(&myPacket{msg: msg})
+			client.Write(buf)
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("the recv loop expected not to be blocked by the handler")
+	}
+	for deadline := time.Now().Add(time.Second); c.RecvQueueLen() < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := c.RecvQueueLen(); n != 3 {
+		t.Errorf("3 packets expected in the recv queue, got %v", n)
+	}
+
+	// EventClosed should be fired after the queued packets handled in order.
+	c.Stop(StopImmediately)
+	close(unblock)
+	if expected, got := []string{"block", "1", "2", "3"}, <-closed; !reflect.DeepEqual(got, expected) {
+		t.Errorf("%v expected, got %v", expected, got)
+	}
+	client.Close()
+}
+
+func TestStopWaitsHandler(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts func(opts *Options)
+	}{
+		{"inline", func(opts *Options) {}},
+		{"worker", func(opts *Options) { opts.SetRecvWorkerPool(2) }},
+		{"queue", func(opts *Options) { opts.SetRecvQueueLen(4) }},
+	} {
+		p := &myProtocol{}
+		// running counts all the handlers in flight, recving only EventRecv.
+		var running, recving, closed int32
+		var recvOverlapped, closeOverlapped, afterClosed int32
+		recvd := make(chan struct{}, 3)
+		done := make(chan struct{})
+		opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if atomic.LoadInt32(&closed) != 0 {
+				atomic.StoreInt32(&afterClosed, 1)
+			}
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			switch et {
+			case EventRecv:
+				if atomic.AddInt32(&recving, 1) > 1 {
+					atomic.StoreInt32(&recvOverlapped, 1)
+				}
+				recvd <- struct{}{}
+				// the reply fires EventSend in the send loop meanwhile.
+				c.Send(&myPacket{msg: "re" + p.String()})
+				time.Sleep(30 * time.Millisecond)
+				atomic.AddInt32(&recving, -1)
+			case EventClosed:
+				if n > 1 {
+					atomic.StoreInt32(&closeOverlapped, 1)
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.StoreInt32(&closed, 1)
+				close(done)
+			}
+		}), p)
+		test.opts(opts)
+		c := NewConn(opts)
+		server, client := net.Pipe()
+		c.RawConn = server
+		go c.serve(EventAccept)
+		go io.Copy(io.Discard, client)
+
+		for _, msg := range []string{"1", "2", "3"} {
+			buf, _ := p.Pack(&myPacket{msg: msg})
+			client.Write(buf)
+		}
+		<-recvd
+		<-recvd
+		c.Stop(StopImmediately)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("%v: EventClosed expected", test.name)
+		}
+		if atomic.LoadInt32(&recvOverlapped) != 0 {
+			t.Errorf("%v: EventRecv expected to run one by one", test.name)
+		}
+		if atomic.LoadInt32(&closeOverlapped) != 0 {
+			t.Errorf("%v: EventClosed expected to wait for the running handlers", test.name)
+		}
+		if atomic.LoadInt32(&afterClosed) != 0 {
+			t.Errorf("%v: no handler expected after EventClosed", test.name)
+		}
+		client.Close()
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	c := NewConn(NewOpts(&myHandler{}, &myProtocol{}))
+	for _, set := range []func(time.Time) error{c.SetDeadline, c.SetReadDeadline, c.SetWriteDeadline} {
+		if err := set(time.Now()); err != ErrNotConnected {
+			t.Errorf("ErrNotConnected expected, got %v", err)
+		}
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	c.RawConn = server
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Errorf("set read deadline err : %v", err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("timeout expected, got %v", err)
+	}
+	server.Close()
+}
+
+// testTLSConfigs return the server and client tls configs with a self-signed certificate.
+func testTLSConfigs(t testing.TB) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key err : ", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create certificate err : ", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	return server, client
+}
+
+func TestTLSHandshakeFailed(t *testing.T) {
+	p := &myProtocol{}
+	serverConfig, _ := testTLSConfigs(t)
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	events := make(chan EventType, 10)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		events <- et
+	}), p).SetTLSConfig(serverConfig))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	// a plaintext client fails the tls handshake.
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer raw.Close()
+	buf, _ := p.Pack(&myPacket{msg: "plaintext"})
+	raw.Write(buf)
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		// skip the tls alert.
+		if _, err = raw.Read(make([]byte, 64)); err != nil {
+			break
+		}
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("the raw conn expected to be closed after the tls handshake failed")
+	}
+	select {
+	case et := <-events:
+		t.Errorf("no event expected for the failed tls handshake, got %v", et)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServeTLSListener(t *testing.T) {
+	p := &myProtocol{}
+	serverConfig, clientConfig := testTLSConfigs(t)
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	accepted := make(chan *Conn, 1)
+	recvs := make(chan string, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventAccept:
+			accepted <- c
+		case EventRecv:
+			recvs <- p.String()
+		}
+	}), p).SetKeepAlivePeriod(time.Minute))
+	go server.Serve(tls.NewListener(l, serverConfig))
+	defer server.Stop(StopImmediately)
+
+	client := NewConn(NewOpts(&myHandler{name: "client"}, p).SetTLSConfig(clientConfig))
+	go client.DialAndServe(l.Addr().String())
+	defer client.Stop(StopImmediately)
+
+	c := <-accepted
+	if _, ok := c.RawConn.(*tls.Conn); !ok {
+		t.Errorf("*tls.Conn expected, got %T", c.RawConn)
+	}
+	if tcpConn := tcpConnOf(c.RawConn); tcpConn == nil {
+		t.Error("the *net.TCPConn under *tls.Conn expected")
+	} else if idle, err := keepAliveIdle(tcpConn); err == nil && idle != time.Minute {
+		t.Errorf("keepalive period %v expected, got %v", time.Minute, idle)
+	}
+	select {
+	case msg := <-recvs:
+		if !strings.HasPrefix(msg, "client") {
+			t.Errorf("the msg from the client expected, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("packet expected to be received over tls")
+	}
+}
+
+func TestUnderlyingConn(t *testing.T) {
+	type result struct {
+		raw net.Conn
+		ok  bool
+	}
+	results := make(chan result, 1)
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			raw, ok := c.UnderlyingConn()
+			results <- result{raw, ok}
+		}
+	}), &myProtocol{}))
+	if raw, ok := c.UnderlyingConn(); raw != nil || ok {
+		t.Errorf("(nil, false) expected before served, got (%v, %v)", raw, ok)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	c.RawConn = server
+	go c.serve(EventAccept)
+
+	if r := <-results; r.raw != server || !r.ok {
+		t.Errorf("(raw, true) expected while serving, got (%v, %v)", r.raw, r.ok)
+	}
+	c.Stop(StopImmediately)
+	if raw, ok := c.UnderlyingConn(); raw != server || ok {
+		t.Errorf("(raw, false) expected after stopped, got (%v, %v)", raw, ok)
+	}
+}
+
+func TestTLSConnectionState(t *testing.T) {
+	p := &myProtocol{}
+	serverConfig, clientConfig := testTLSConfigs(t)
+	serverConfig.NextProtos = []string{"xtcp"}
+	clientConfig.NextProtos = []string{"xtcp"}
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	states := make(chan tls.ConnectionState, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p).
+		SetTLSConfig(serverConfig).SetOnHandshake(func(c *Conn) error {
+		state, ok := c.TLSConnectionState()
+		if !ok {
+			return errors.New("tls connection state expected")
+		}
+		states <- state
+		return nil
+	}))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	connected := make(chan *Conn, 1)
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventConnected {
+			connected <- c
+		}
+	}), p).SetTLSConfig(clientConfig))
+	go client.DialAndServe(l.Addr().String())
+	defer client.Stop(StopImmediately)
+
+	select {
+	case state := <-states:
+		if state.NegotiatedProtocol != "xtcp" {
+			t.Errorf("ALPN xtcp expected, got %q", state.NegotiatedProtocol)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnHandshake expected to get the tls connection state")
+	}
+	select {
+	case c := <-connected:
+		if state, ok := c.TLSConnectionState(); !ok || state.NegotiatedProtocol != "xtcp" || len(state.PeerCertificates) == 0 {
+			t.Errorf("tls connection state with the server cert expected, got %+v, %v", state, ok)
+		}
+	case <-time.After(time.Second):
+		t.Error("client expected to connect")
+	}
+
+	plain, _ := net.Pipe()
+	defer plain.Close()
+	if _, ok := (&Conn{RawConn: plain}).TLSConnectionState(); ok {
+		t.Error("false expected for the non-tls conn")
+	}
+}
+
+func TestProtocolSelector(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	serverConfig.NextProtos = []string{"line", "xtcp"}
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	line := NewDelimiterProtocol('\n', 0)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			c.Send(p) // echo by the protocol of the conn.
+		}
+	}), &myProtocol{}).SetTLSConfig(serverConfig).SetProtocolSelector(func(c *Conn) Protocol {
+		if state, ok := c.TLSConnectionState(); ok && state.NegotiatedProtocol == "line" {
+			return line
+		}
+		return nil
+	}))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	for _, test := range []struct {
+		alpn     string
+		protocol Protocol
+		packet   Packet
+	}{
+		{"line", line, DelimiterPacket("hello")},
+		{"xtcp", &myProtocol{}, &myPacket{msg: "hello"}},
+	} {
+		config := clientConfig.Clone()
+		config.NextProtos = []string{test.alpn}
+		echo := make(chan string, 1)
+		client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			switch et {
+			case EventConnected:
+				c.Send(test.packet)
+			case EventRecv:
+				echo <- p.String()
+			}
+		}), test.protocol).SetTLSConfig(config))
+		go client.DialAndServe(l.Addr().String())
+		select {
+		case msg := <-echo:
+			if msg != "hello" {
+				t.Errorf("%v: hello expected, got %v", test.alpn, msg)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: echo expected by the selected protocol", test.alpn)
+		}
+		client.Stop(StopImmediately)
+	}
+}
+
+func TestLinger(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	accepted := make(chan *Conn, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- c
+		}
+	}), &myProtocol{}).SetLinger(0))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer raw.Close()
+	c := <-accepted
+	c.Stop(StopImmediately)
+
+	// 0 linger reset the conn instead of a normal close.
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := raw.Read(make([]byte, 1)); err == nil || err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("connection reset expected with 0 linger, got %v", err)
+	}
+}
+
+func TestPacketsDropped(t *testing.T) {
+	p := &myProtocol{}
+	server, client := net.Pipe()
+	c := NewConn(NewOpts(&myHandler{}, p))
+	c.RawConn = server
+	go c.serve(EventAccept)
+
+	// the client never read, so the first packet blocks the send loop.
+	c.Send(&myPacket{msg: "first"})
+	for c.SendQueueLen() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		c.Send(&myPacket{msg: "queued"})
+	}
+	c.Stop(StopImmediately)
+	<-c.Done()
+	if dropped := c.Stats().PacketsDropped; dropped != 3 {
+		t.Errorf("3 dropped packets expected, got %v", dropped)
+	}
+	client.Close()
+
+	server, client = net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	c = NewConn(NewOpts(&myHandler{}, p))
+	c.RawConn = server
+	go c.serve(EventAccept)
+	for i := 0; i < 10; i++ {
+		c.Send(&myPacket{msg: "queued"})
+	}
+	c.Stop(StopGracefullyAndWait)
+	<-c.Done()
+	if stats := c.Stats(); stats.PacketsDropped != 0 || stats.PacketsSent != 10 {
+		t.Errorf("10 sent and 0 dropped packets expected for graceful stop, got %+v", stats)
+	}
+
+	// stopped before the send loop started, it may take a packet from the send list before seeing the stop.
+	for i := 0; i < 20; i++ {
+		server, client := net.Pipe()
+		c := NewConn(NewOpts(&myHandler{}, p))
+		c.RawConn = server
+		for j := 0; j < 3; j++ {
+			c.Send(&myPacket{msg: "queued"})
+		}
+		c.Stop(StopImmediately)
+		c.serve(EventAccept)
+		if dropped := c.Stats().PacketsDropped; dropped != 3 {
+			t.Errorf("3 dropped packets expected if stopped before sent, got %v", dropped)
+			break
+		}
+		client.Close()
+	}
+}
+
+func TestListenAndDial(t *testing.T) {
+	var listenControl, dialControl int32
+	l, err := Listen("tcp4:127.0.0.1:", net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if network != "tcp4" {
+				t.Errorf("tcp4 expected, got %v", network)
+			}
+			atomic.AddInt32(&listenControl, 1)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	defer l.Close()
+	if atomic.LoadInt32(&listenControl) == 0 {
+		t.Error("the listen control expected to be called")
+	}
+
+	d := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&dialControl, 1)
+		return nil
+	}}
+	conn, err := Dial(l.Addr().String(), d)
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	conn.Close()
+
+	connected := make(chan struct{})
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventConnected {
+			close(connected)
+			c.Stop(StopImmediately)
+		}
+	}), &myProtocol{}).SetDialer(&d))
+	go client.DialAndServe(l.Addr().String())
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Error("client expected to connect")
+	}
+	if n := atomic.LoadInt32(&dialControl); n != 2 {
+		t.Errorf("the dial control expected to be called by Dial and DialAndServe, got %v calls", n)
+	}
+}
+
+// failWriteConn is a net.Conn which always fails to write.
+type failWriteConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failWriteConn) Write(b []byte) (int, error) {
+	return 0, c.err
+}
+
+// countWriteConn is a net.Conn which counts the Write calls.
+type countWriteConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countWriteConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestWriteBuf(t *testing.T) {
+	p := &myProtocol{}
+	const count = 10
+	for _, test := range []struct {
+		writeBufLen int
+		writes      int32
+	}{
+		{DefaultWriteBufLen, 1}, // coalesced into one write, flushed when the send list drained.
+		{0, count},              // write each packet directly.
+	} {
+		server, client := net.Pipe()
+		raw := &countWriteConn{Conn: server}
+		c := NewConn(NewOpts(&myHandler{}, p).SetSendListLen(count).SetWriteBufLen(test.writeBufLen))
+		c.RawConn = raw
+		// queued before served, so the send loop sees all of them.
+		for i := 0; i < count; i++ {
+			c.Send(&myPacket{msg: "small"})
+		}
+		go c.serve(EventAccept)
+
+		buf, _ := p.Pack(&myPacket{msg: "small"})
+		data := make([]byte, count*len(buf))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, data); err != nil {
+			t.Errorf("writeBufLen[%v]: all the packets expected to be flushed, got %v", test.writeBufLen, err)
+		}
+		if n := atomic.LoadInt32(&raw.writes); n != test.writes {
+			t.Errorf("writeBufLen[%v]: %v writes expected, got %v", test.writeBufLen, test.writes, n)
+		}
+
+		// a lone small packet is flushed without more sends.
+		c.Send(&myPacket{msg: "lone"})
+		lone, _ := p.Pack(&myPacket{msg: "lone"})
+		if _, err := io.ReadFull(client, make([]byte, len(lone))); err != nil {
+			t.Errorf("writeBufLen[%v]: the lone packet expected to be flushed, got %v", test.writeBufLen, err)
+		}
+		c.Stop(StopImmediately)
+		client.Close()
+	}
+}
+
+func TestLastError(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	writeErr := errors.New("broken pipe")
+	c := NewConn(NewOpts(&myHandler{}, &myProtocol{}))
+	c.RawConn = &failWriteConn{Conn: server, err: writeErr}
+	if err := c.LastError(); err != nil {
+		t.Errorf("nil expected before any error, got %v", err)
+	}
+	go c.serve(EventAccept)
+
+	c.Send(&myPacket{msg: "hello"})
+	<-c.Done()
+	if err := c.Send(&myPacket{msg: "again"}); err != ErrConnClosed {
+		t.Errorf("ErrConnClosed expected, got %v", err)
+	}
+	if err := c.LastError(); err != writeErr {
+		t.Errorf("%v expected, got %v", writeErr, err)
+	}
+	if r := c.CloseReason(); r != CloseReasonWriteError {
+		t.Errorf("%v expected, got %v", CloseReasonWriteError, r)
+	}
+}
+
+func TestMaxSendBytes(t *testing.T) {
+	p := &myProtocol{}
+	// the packed size is 4 + len(msg).
+	packet := func(size int) Packet {
+		return &myPacket{msg: strings.Repeat("x", size-4)}
+	}
+	for _, policy := range []SendOverflowPolicy{SendOverflowBlock, SendOverflowDropNewest, SendOverflowDropOldest} {
+		server, client := net.Pipe()
+		c := NewConn(NewOpts(&myHandler{}, p).SetMaxSendBytes(100).SetSendOverflowPolicy(policy))
+		c.RawConn = server
+		go c.serve(EventAccept)
+
+		// the client not read yet, so the send loop is blocked by the first packet.
+		c.Send(packet(200))
+		for c.SendQueueLen() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if n := c.SendQueueBytes(); n != 0 {
+			t.Errorf("policy[%v]: 0 queued bytes expected after taken, got %v", policy, n)
+		}
+		c.Send(packet(40))
+		c.Send(packet(40))
+		c.Send(packet(20))
+		if n := c.SendQueueBytes(); n != 100 {
+			t.Errorf("policy[%v]: 100 queued bytes expected, got %v", policy, n)
+		}
+
+		errs := make(chan error, 1)
+		go func() { errs <- c.Send(packet(30)) }()
+		switch policy {
+		case SendOverflowBlock:
+			select {
+			case err := <-errs:
+				t.Errorf("policy[%v]: Send expected to block, got %v", policy, err)
+			case <-time.After(20 * time.Millisecond):
+			}
+			// the send loop take the rest after the client read.
+			go io.Copy(io.Discard, client)
+			if err := <-errs; err != nil {
+				t.Errorf("policy[%v]: nil expected after the bytes freed, got %v", policy, err)
+			}
+		case SendOverflowDropNewest:
+			if err := <-errs; err != ErrPacketDropped {
+				t.Errorf("policy[%v]: ErrPacketDropped expected, got %v", policy, err)
+			}
+			if n := c.SendQueueBytes(); n != 100 {
+				t.Errorf("policy[%v]: 100 queued bytes expected, got %v", policy, n)
+			}
+		case SendOverflowDropOldest:
+			if err := <-errs; err != nil {
+				t.Errorf("policy[%v]: nil expected, got %v", policy, err)
+			}
+			// the first 40 bytes packet dropped.
+			if n, queued := c.SendQueueBytes(), c.SendQueueLen(); n != 90 || queued != 3 {
+				t.Errorf("policy[%v]: 3 packets with 90 bytes expected, got %v with %v bytes", policy, queued, n)
+			}
+		}
+		c.Stop(StopImmediately)
+		<-c.Done()
+		if n := c.SendQueueBytes(); n != 0 {
+			t.Errorf("policy[%v]: 0 queued bytes expected after closed, got %v", policy, n)
+		}
+		client.Close()
+	}
+}
+
+func TestWritableNotify(t *testing.T) {
+	p := &myProtocol{}
+	server, client := net.Pipe()
+	c := NewConn(NewOpts(&myHandler{}, p).SetSendListLen(2).SetSendOverflowPolicy(SendOverflowDropNewest))
+	c.RawConn = server
+	go c.serve(EventAccept)
+
+	// the client not read yet, so the send loop is blocked by the first packet.
+	c.Send(&myPacket{msg: "first"})
+	for c.SendQueueLen() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for c.Send(&myPacket{msg: "fill"}) == nil {
+	}
+	go io.Copy(io.Discard, client)
+	select {
+	case <-c.WritableNotify():
+		if err := c.Send(&myPacket{msg: "more"}); err != nil {
+			t.Errorf("send expected to succeed after writable, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("writable expected to be notified")
+	}
+
+	// the waiter wakes up if the conn closed.
+	waiter := make(chan struct{})
+	go func() {
+		for range c.WritableNotify() {
+		}
+		close(waiter)
+	}()
+	c.Stop(StopImmediately)
+	select {
+	case <-waiter:
+	case <-time.After(time.Second):
+		t.Error("the waiter expected to wake up after the conn closed")
+	}
+	client.Close()
+}
+
+func TestSendOverflowPolicy(t *testing.T) {
+	queued := func(c *Conn) (msgs []string) {
+		for len(c.sendPackets) > 0 {
+			p := <-c.sendPackets
+			if wp, ok := p.(*waitPacket); ok {
+				p = wp.Packet
+			}
+			msgs = append(msgs, p.String())
+		}
+		return msgs
+	}
+	p := &myProtocol{}
+
+	// the conn is not served, so the send list is saturated.
+	c := NewConn(NewOpts(&myHandler{}, p).SetSendListLen(2))
+	c.Send(&myPacket{msg: "1"})
+	c.Send(&myPacket{msg: "2"})
+	if err := c.SendWithTimeout(&myPacket{msg: "3"}, 20*time.Millisecond); err != ErrSendTimeout {
+		t.Errorf("block: ErrSendTimeout expected, got %v", err)
+	}
+	blocked := make(chan error, 1)
+	go func() { blocked <- c.Send(&myPacket{msg: "3"}) }()
+	select {
+	case err := <-blocked:
+		t.Errorf("block: Send expected to block, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	<-c.sendPackets
+	if err := <-blocked; err != nil {
+		t.Errorf("block: Send expected to return nil after room made, got %v", err)
+	}
+
+	c = NewConn(NewOpts(&myHandler{}, p).SetSendListLen(2).SetSendOverflowPolicy(SendOverflowDropNewest))
+	c.Send(&myPacket{msg: "1"})
+	c.SendPriority(&myPacket{msg: "p"})
+	c.Send(&myPacket{msg: "2"})
+	if err := c.Send(&myPacket{msg: "3"}); err != ErrPacketDropped {
+		t.Errorf("drop newest: ErrPacketDropped expected, got %v", err)
+	}
+	if msgs := queued(c); !reflect.DeepEqual(msgs, []string{"1", "2"}) {
+		t.Errorf("drop newest: [1 2] expected, got %v", msgs)
+	}
+
+	c = NewConn(NewOpts(&myHandler{}, p).SetSendListLen(2).SetSendOverflowPolicy(SendOverflowDropOldest))
+	waited := make(chan error, 1)
+	go func() { waited <- c.SendAndWait(&myPacket{msg: "1"}) }()
+	for c.SendQueueLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Send(&myPacket{msg: "2"})
+	if err := c.Send(&myPacket{msg: "3"}); err != nil {
+		t.Errorf("drop oldest: nil expected, got %v", err)
+	}
+	if err := <-waited; err != ErrPacketDropped {
+		t.Errorf("drop oldest: ErrPacketDropped expected for SendAndWait, got %v", err)
+	}
+	if msgs := queued(c); !reflect.DeepEqual(msgs, []string{"2", "3"}) {
+		t.Errorf("drop oldest: [2 3] expected, got %v", msgs)
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	for _, batch := range []int{0, 4} {
+		p := &myProtocol{}
+		server, client := net.Pipe()
+		var sends []Packet
+		c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if et == EventSend {
+				sends = append(sends, p)
+			}
+		}), p).SetWriteBatch(batch))
+		c.RawConn = server
+		go c.serve(EventAccept)
+
+		raw, _ := p.Pack(&myPacket{msg: "raw"})
+		c.Send(&myPacket{msg: "first"})
+		c.SendRaw(raw)
+		c.Send(&myPacket{msg: "last"})
+
+		for _, msg := range []string{"first", "raw", "last"} {
+			buf := make([]byte, 4+len(msg))
+			io.ReadFull(client, buf)
+			if p, _, _ := p.Unpack(buf); p == nil || p.String() != msg {
+				t.Errorf("batch[%v]: %v expected, got %q", batch, msg, buf)
+			}
+		}
+		c.Stop(StopImmediately)
+		<-c.Done()
+		if len(sends) != 3 || !bytes.Equal(sends[1].(RawPacket), raw) {
+			t.Errorf("batch[%v]: RawPacket expected with EventSend, got %v", batch, sends)
+		}
+		client.Close()
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			// response before the recv loop read EOF.
+			c.SendAndWait(&myPacket{msg: "resp:" + p.(*myPacket).msg})
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	for _, batch := range []int{0, 4} {
+		connected := make(chan struct{})
+		resps := make(chan string, 1)
+		client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			switch et {
+			case EventConnected:
+				close(connected)
+			case EventRecv:
+				resps <- p.(*myPacket).msg
+			}
+		}), p).SetWriteBatch(batch))
+		go client.DialAndServe(l.Addr().String())
+		<-connected
+
+		client.Send(&myPacket{msg: "req"})
+		if err := client.CloseWrite(); err != nil {
+			t.Errorf("batch[%v]: close write err : %v", batch, err)
+		}
+		if err := client.Send(&myPacket{msg: "more"}); err != ErrWriteClosed {
+			t.Errorf("batch[%v]: ErrWriteClosed expected after close write, got %v", batch, err)
+		}
+		select {
+		case resp := <-resps:
+			if resp != "resp:req" {
+				t.Errorf("batch[%v]: 'resp:req' expected, got %v", batch, resp)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("batch[%v]: response expected after close write", batch)
+		}
+		<-client.Done()
+	}
+
+	server2, _ := net.Pipe()
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	c.RawConn = server2
+	if err := c.CloseWrite(); err != ErrCloseWriteUnsupported {
+		t.Errorf("ErrCloseWriteUnsupported expected for pipe, got %v", err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	panics := make(chan interface{}, 2)
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			if c.Stats().PacketsRecv == 3 {
+				panic("3rd recv")
+			}
+		}
+	}), p).SetOnPanic(func(c *Conn, v interface{}) {
+		panics <- v
+	})
+	server := NewServer(opts)
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	// the server should stay up after the handler panics.
+	for i := 0; i < 2; i++ {
+		client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if et == EventConnected {
+				for i := 0; i < 5; i++ {
+					c.Send(&myPacket{msg: "panic"})
+				}
+			}
+		}), p))
+		done := make(chan struct{})
+		go func() {
+			client.DialAndServe(l.Addr().String())
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("conn expected to be closed after handler panic")
+			client.Stop(StopImmediately)
+		}
+		select {
+		case v := <-panics:
+			if v != "3rd recv" {
+				t.Errorf("'3rd recv' panic expected, got %v", v)
+			}
+		default:
+			t.Error("OnPanic expected to be called")
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xtcp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	p := &myProtocol{}
+	hs := &myHandler{name: "server - response : "}
+	server := NewServer(NewOpts(hs, p))
+	serverStopped := make(chan struct{})
+	go func() {
+		server.Serve(l)
+		close(serverStopped)
+	}()
+
+	hc := &myHandler{name: "client - request : "}
+	client := NewConn(NewOpts(hc, p))
+	err = client.DialAndServe("unix:" + path)
+	if err != nil {
+		t.Error("client dial err : ", err)
+	}
+	server.Stop(StopGracefullyAndWait)
+	<-serverStopped
+
+	if len(hc.recvs) == 0 || !reflect.DeepEqual(hs.sends, hc.recvs) {
+		t.Errorf("server send (%v) != client recv (%v)", len(hs.sends), len(hc.recvs))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket file expected to be removed after server stop")
+	}
+}
+
+func TestStopAccepting(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			c.Send(p) // echo.
+		}
+	}), p))
+	serveExit := make(chan struct{})
+	go func() {
+		server.Serve(l)
+		close(serveExit)
+	}()
+	defer server.Stop(StopImmediately)
+
+	connected := make(chan struct{})
+	echo := make(chan struct{}, 1)
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			close(connected)
+		case EventRecv:
+			echo <- struct{}{}
+		}
+	}), p))
+	go client.DialAndServe(l.Addr().String())
+	defer client.Stop(StopImmediately)
+	<-connected
+
+	server.StopAccepting()
+	<-serveExit
+
+	client.Send(&myPacket{msg: "still alive"})
+	select {
+	case <-echo:
+	case <-time.After(time.Second):
+		t.Error("accepted conn expected to keep running after StopAccepting")
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("dial expected to fail after StopAccepting")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	testMaxConns(t, func(opts *Options) { opts.SetMaxConns(1) })
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	testMaxConns(t, func(opts *Options) { opts.SetMaxConnsPerIP(1) })
+}
+
+func testMaxConns(t *testing.T, limit func(opts *Options)) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	accepted := make(chan struct{}, 2)
+	rejected := make(chan struct{}, 1)
+	opts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- struct{}{}
+		}
+	}), p).SetOnReject(func(raw net.Conn) {
+		rejected <- struct{}{}
+	})
+	limit(opts)
+	server := NewServer(opts)
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	h := funcHandler(func(et EventType, c *Conn, p Packet) {})
+	first := NewConn(NewOpts(h, p))
+	// first will be closed by server.Stop.
+	go first.DialAndServe(l.Addr().String())
+	<-accepted
+
+	last := NewConn(NewOpts(h, p))
+	done := make(chan struct{})
+	go func() {
+		last.DialAndServe(l.Addr().String())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the conn beyond MaxConns expected to be closed")
+		last.Stop(StopImmediately)
+	}
+	select {
+	case <-rejected:
+	default:
+		t.Error("OnReject expected to be called")
+	}
+	if len(accepted) != 0 {
+		t.Error("EventAccept not expected for the rejected conn")
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	l1, err := ListenReusePort("127.0.0.1:0")
+	if err == ErrReusePortUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	defer l1.Close()
+	l2, err := ListenReusePort(l1.Addr().String())
+	if err != nil {
+		t.Fatal("listen the same port err : ", err)
+	}
+	defer l2.Close()
+
+	p := &myProtocol{}
+	accepted := make(chan struct{}, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- struct{}{}
+			c.Stop(StopImmediately)
+		}
+	}), p))
+	go server.Serve(l2)
+	defer server.Stop(StopImmediately)
+	l1.Close()
+
+	// l1 closed, so the conn must be accepted by l2.
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	done := make(chan struct{})
+	go func() {
+		// closed by the server after accepted.
+		client.DialAndServe(l1.Addr().String())
+		close(done)
+	}()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Error("conn expected to be accepted by the second listener")
+	}
+	<-done
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(2)
+	now := tb.last
+	if tb.take(now) != 0 || tb.take(now) != 0 {
+		t.Error("take expected to succeed within the rate")
+	}
+	if wait := tb.take(now); wait != 500*time.Millisecond {
+		t.Errorf("500ms wait expected, got %v", wait)
+	}
+	if tb.take(now.Add(500*time.Millisecond)) != 0 {
+		t.Error("take expected to succeed after wait")
+	}
+}
+
+func TestServeContextCancel(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.ServeContext(ctx, l)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("server expected to stop after context cancelled")
+	}
+	// stop again after context cancelled should not panic.
+	server.Stop(StopImmediately)
+}
+
+func TestServerWait(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	accepted := make(chan struct{})
+	var closed int32
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventAccept:
+			close(accepted)
+		case EventClosed:
+			atomic.StoreInt32(&closed, 1)
+		}
+	}), p))
+	go server.Serve(l)
+
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	go client.DialAndServe(l.Addr().String())
+	<-accepted
+
+	server.Stop(StopGracefullyButNotWait)
+	server.Wait()
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Error("all conns expected to be closed after Wait returns")
+	}
+	<-client.Done()
+}
+
+func TestConnByID(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	accepted := make(chan *Conn, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- c
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	go client.DialAndServe(l.Addr().String())
+	c := <-accepted
+	if found, ok := server.ConnByID(c.GetID()); !ok || found != c {
+		t.Error("accepted conn expected to be found by id")
+	}
+
+	// the server side conn stopped, the client will be closed too.
+	c.Stop(StopImmediately)
+	<-client.Done()
+	// the conn is removed after it's done.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := server.ConnByID(c.GetID()); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error("closed conn not expected to be found by id")
+			break
+		}
+	}
+}
+
+func TestConnHooks(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	events := make(chan string, 10)
+	rejected := make(chan struct{}, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p).SetMaxConns(1).
+		SetOnReject(func(raw net.Conn) { rejected <- struct{}{} }).
+		SetConnHooks(func(c *Conn) { events <- fmt.Sprintf("added#%d", c.GetID()) },
+			func(c *Conn) { events <- fmt.Sprintf("removed#%d", c.GetID()) }))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	expect := func(expected string) {
+		select {
+		case e := <-events:
+			if !strings.HasPrefix(e, expected) {
+				t.Errorf("%v expected, got %v", expected, e)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v expected", expected)
+		}
+	}
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	expect("added")
+
+	// rejected by MaxConns, never added.
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer second.Close()
+	<-rejected
+	first.Close()
+	expect("removed")
+
+	third, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer third.Close()
+	expect("added")
+	server.Stop(StopGracefullyAndWait)
+	expect("removed")
+	select {
+	case e := <-events:
+		t.Errorf("no more events expected, got %v", e)
+	default:
+	}
+}
+
+func TestServerRange(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	accepted := make(chan struct{}, 3)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			accepted <- struct{}{}
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	for i := 0; i < 3; i++ {
+		raw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("dial err : ", err)
+		}
+		defer raw.Close()
+		<-accepted
+	}
+
+	visited := make(map[*Conn]bool)
+	server.Range(func(c *Conn) bool {
+		visited[c] = true
+		return true
+	})
+	if len(visited) != 3 {
+		t.Errorf("3 conns expected to be visited, got %v", len(visited))
+	}
+	n := 0
+	server.Range(func(c *Conn) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Range expected to stop after f returns false, visited %v", n)
+	}
+
+	// f can call the methods of the conn and the server.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Range(func(c *Conn) bool {
+			if err := c.Send(&myPacket{msg: "bye"}); err != nil {
+				t.Errorf("send err : %v", err)
+			}
+			c.Stop(StopGracefullyButNotWait)
+			server.ConnCount()
+			return true
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Range expected not to hold the lock of server while calling f")
+	}
+	for deadline := time.Now().Add(time.Second); server.ConnCount() != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := server.ConnCount(); n != 0 {
+		t.Errorf("all the conns expected to be stopped in Range, got %v", n)
+	}
+}
+
+func TestConnHooksStopRace(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	var mu sync.Mutex
+	events := make(map[uint64][]string)
+	record := func(c *Conn, e string) {
+		mu.Lock()
+		events[c.GetID()] = append(events[c.GetID()], e)
+		mu.Unlock()
+	}
+	added := make(chan struct{}, 1)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p).
+		SetConnHooks(func(c *Conn) {
+			select {
+			case added <- struct{}{}:
+			default:
+			}
+			// let Stop land while OnConnAdded running.
+			time.Sleep(5 * time.Millisecond)
+			record(c, "added")
+		}, func(c *Conn) { record(c, "removed") }))
+	go server.Serve(l)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		go func() {
+			if raw, err := net.Dial("tcp", l.Addr().String()); err == nil {
+				defer raw.Close()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+	<-added
+	server.Stop(StopGracefullyAndWait)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 {
+		t.Error("some conns expected to be added")
+	}
+	for id, es := range events {
+		if len(es) != 2 || es[0] != "added" || es[1] != "removed" {
+			t.Errorf("conn %v: [added removed] expected, got %v", id, es)
+		}
+	}
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	recvs := make(chan string, 2)
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			recvs <- p.String()
+		}
+	}), p).SetEnableProxyProtocol(true).SetMaxConcurrentHandshakes(1))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	header := []byte("PROXY TCP4 10.1.2.3 10.0.0.1 40000 443\r\n")
+	buf, _ := p.Pack(&myPacket{msg: "hello"})
+	// the slow client doesn't send the header, so it's handshaking.
+	slow, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer slow.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	fast, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	defer fast.Close()
+	fast.Write(append(header, buf...))
+	select {
+	case msg := <-recvs:
+		t.Errorf("the fast client not expected to be served before the slow one handshake done, got %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	slow.Write(header)
+	select {
+	case <-recvs:
+	case <-time.After(time.Second):
+		t.Error("the fast client expected to be served after the slow one handshake done")
+	}
+}
+
+func TestNewPipeConns(t *testing.T) {
+	p := &myProtocol{}
+	recvs := make(chan string, 1)
+	clientOpts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			recvs <- p.String()
+		}
+	}), p)
+	serverOpts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			c.Send(&myPacket{msg: "echo " + p.String()})
+		}
+	}), p)
+	client, server := NewPipeConns(clientOpts, serverOpts)
+	client.Send(&myPacket{msg: "hello"})
+	select {
+	case msg := <-recvs:
+		if msg != "echo hello" {
+			t.Errorf("'echo hello' expected, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("echo expected")
+	}
+
+	client.Stop(StopImmediately)
+	<-client.Done()
+	<-server.Done()
+}
+
+func TestSendBatch(t *testing.T) {
+	p := &myProtocol{}
+	const senders, groups, groupLen = 4, 20, 5
+	total := senders * groups * (groupLen + 1)
+	recvs := make(chan string, total)
+	clientOpts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			recvs <- p.String()
+		}
+	}), p)
+	serverOpts := NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p).SetSendListLen(4)
+	client, server := NewPipeConns(clientOpts, serverOpts)
+	defer client.Stop(StopImmediately)
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for g := 0; g < groups; g++ {
+				var ps []Packet
+				for j := 0; j < groupLen; j++ {
+					ps = append(ps, &myPacket{msg: fmt.Sprintf("%v-%v-%v", i, g, j)})
+				}
+				if err := server.SendBatch(ps); err != nil {
+					t.Error("send batch err : ", err)
+				}
+				// the single packets try to split the groups.
+				server.Send(&myPacket{msg: "single"})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the packets of a group must be received contiguously.
+	for n := 0; n < total; n++ {
+		var msg string
+		select {
+		case msg = <-recvs:
+		case <-time.After(time.Second):
+			t.Fatalf("%v packets expected, got %v", total, n)
+		}
+		if msg == "single" {
+			continue
+		}
+		var i, g, j int
+		fmt.Sscanf(msg, "%d-%d-%d", &i, &g, &j)
+		if j != 0 {
+			t.Fatalf("the first packet of a group expected, got %v", msg)
+		}
+		for j = 1; j < groupLen; j++ {
+			expected := fmt.Sprintf("%v-%v-%v", i, g, j)
+			if msg = <-recvs; msg != expected {
+				t.Fatalf("%v expected in the group, got %v", expected, msg)
+			}
+			n++
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	p := &myProtocol{}
+	for _, batch := range []int{0, 4} {
+		c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p).SetWriteBufLen(4096).SetWriteBatch(batch))
+		server, client := net.Pipe()
+		c.RawConn = server
+		go c.serve(EventAccept)
+
+		go io.Copy(io.Discard, client)
+		total := 0
+		for i := 0; i < 10; i++ {
+			c.Send(&myPacket{msg: "hello"})
+			total += p.PackSize(&myPacket{msg: "hello"})
+		}
+		if err := c.Flush(); err != nil {
+			t.Errorf("batch[%v]: flush err : %v", batch, err)
+		}
+		if n := c.Stats().BytesSent; n != uint64(total) {
+			t.Errorf("batch[%v]: %v bytes expected to be written after flush, got %v", batch, total, n)
+		}
+
+		c.Stop(StopImmediately)
+		<-c.Done()
+		if err := c.Flush(); err != ErrConnClosed {
+			t.Errorf("batch[%v]: ErrConnClosed expected after stop, got %v", batch, err)
+		}
+		client.Close()
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	p := &myProtocol{}
+	events := make(chan time.Time, 10)
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventBackpressure {
+			events <- time.Now()
+		}
+	}), p).SetSendListLen(2).SetWriteBufLen(0).SetBackpressureThreshold(40 * time.Millisecond))
+	server, client := net.Pipe()
+	c.RawConn = server
+	go c.serve(EventAccept)
+	defer client.Close()
+
+	// the client never read, so the send loop blocks on the first packet, then the send list is full.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		c.Send(&myPacket{msg: "hello"})
+	}
+	select {
+	case at := <-events:
+		if d := at.Sub(start); d < 40*time.Millisecond {
+			t.Errorf("EventBackpressure expected after the threshold, got %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("EventBackpressure expected when the send list stays full")
+	}
+	// throttled, fired again after another threshold.
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Error("EventBackpressure expected to fire again while the send list stays full")
+	}
+
+	// drained, no more events.
+	go io.Copy(io.Discard, client)
+	for c.SendQueueLen() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for len(events) > 0 {
+		<-events
+	}
+	select {
+	case <-events:
+		t.Error("EventBackpressure not expected after the send list drained")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Stop(StopImmediately)
+	<-c.Done()
+}
+
+func TestAdopt(t *testing.T) {
+	p := &myProtocol{}
+	events := make(chan EventType, 10)
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected, EventClosed:
+			events <- et
+		case EventRecv:
+			c.Send(p) // echo.
+		}
+	}), p))
+	raw, peer := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- c.Adopt(raw)
+	}()
+	if et := <-events; et != EventConnected {
+		t.Errorf("EventConnected expected, got %v", et)
+	}
+
+	buf, _ := p.Pack(&myPacket{msg: "hello"})
+	peer.Write(buf)
+	echo := make([]byte, len(buf))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(peer, echo); err != nil || !bytes.Equal(echo, buf) {
+		t.Errorf("echo expected from the adopted conn, got %q, %v", echo, err)
+	}
+
+	// Stop closes the raw conn like a dialed conn.
+	c.Stop(StopImmediately)
+	if et := <-events; et != EventClosed {
+		t.Errorf("EventClosed expected, got %v", et)
+	}
+	if err := <-served; err != nil {
+		t.Error("nil expected after adopted conn closed, got ", err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("EOF expected after stop, got %v", err)
+	}
+}
+
+func TestAdoptTLS(t *testing.T) {
+	p := &myProtocol{}
+	serverConfig, clientConfig := testTLSConfigs(t)
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal("listen err : ", err)
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			c.Send(p) // echo.
+		}
+	}), p).SetTLSConfig(serverConfig))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	// the ServerName is taken from the remote addr, like DialAndServe.
+	clientConfig.ServerName = ""
+	recvs := make(chan string, 1)
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			c.Send(&myPacket{msg: "hello"})
+		case EventRecv:
+			recvs <- p.String()
+		}
+	}), p).SetTLSConfig(clientConfig))
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial err : ", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- c.Adopt(raw)
+	}()
+	select {
+	case msg := <-recvs:
+		if msg != "hello" {
+			t.Errorf("hello expected, got %v", msg)
+		}
+	case err := <-served:
+		t.Fatalf("the tls handshake of the adopted conn failed : %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("echo expected from the tls server")
+	}
+	c.Stop(StopImmediately)
+	<-served
+}
+
+func TestServerStopWithTimeout(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	big := &myPacket{msg: strings.Repeat("x", 1000)}
+	full := make(chan struct{})
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventAccept {
+			go func() {
+				// fill the send list until the socket blocked.
+				for c.SendWithTimeout(big, 100*time.Millisecond) == nil {
+				}
+				close(full)
+			}()
+		}
+	}), p))
+	go server.Serve(l)
+
+	// the raw conn never read, so the server can't drain the send list.
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error("dial err : ", err)
+		return
+	}
+	defer raw.Close()
+	<-full
+
+	start := time.Now()
+	if n := server.StopWithTimeout(StopGracefullyAndWait, 50*time.Millisecond); n != 1 {
+		t.Errorf("1 conn expected to be force closed, got %v", n)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("StopWithTimeout expected to return after timeout, took %v", d)
+	}
+	if n := server.StopWithTimeout(StopGracefullyAndWait, 0); n != 0 {
+		t.Errorf("0 expected for the second stop, got %v", n)
+	}
+}
+
+// errListener is a net.Listener which always fails to accept.
+type errListener struct {
+	net.Listener
+	err error
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestOnAcceptError(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	acceptErr := errors.New("accept failed")
+	var errs []error
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).
+		SetOnAcceptError(func(err error) bool {
+			errs = append(errs, err)
+			// retry twice.
+			return len(errs) < 3
+		}))
+	if err := server.Serve(&errListener{Listener: l, err: acceptErr}); err != acceptErr {
+		t.Errorf("the accept error expected, got %v", err)
+	}
+	if len(errs) != 3 {
+		t.Errorf("OnAcceptError expected to be called 3 times, got %v", len(errs))
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	acceptErr := errors.New("accept failed")
+	var times []time.Time
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).
+		SetAcceptBackoff(30*time.Millisecond, 30*time.Millisecond).
+		SetOnAcceptError(func(err error) bool {
+			times = append(times, time.Now())
+			return len(times) < 4
+		}))
+	if err := server.Serve(&errListener{Listener: l, err: acceptErr}); err != acceptErr {
+		t.Errorf("the accept error expected, got %v", err)
+	}
+	for i := 1; i < len(times); i++ {
+		// the default starts from 5ms and doubles up to 1s.
+		if d := times[i].Sub(times[i-1]); d < 30*time.Millisecond || d > 500*time.Millisecond {
+			t.Errorf("retry %v: 30ms delay expected, got %v", i, d)
+		}
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}))
+	if server.Addr() != nil {
+		t.Error("nil addr expected before serve")
+	}
+	go server.Serve(l)
+	for deadline := time.Now().Add(time.Second); server.Addr() == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if addr := server.Addr(); addr == nil || addr.String() != l.Addr().String() {
+		t.Errorf("%v expected, got %v", l.Addr(), addr)
+	}
+	server.Stop(StopGracefullyAndWait)
+	if server.Addr() != nil {
+		t.Error("nil addr expected after stop")
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	var lis []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Error("listen err : ", err)
+			return
+		}
+		lis = append(lis, l)
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}))
+	serveExit := make(chan error, 1)
+	go func() {
+		serveExit <- server.ServeAll(lis...)
+	}()
+	for deadline := time.Now().Add(time.Second); len(server.Addrs()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Errorf("2 addrs expected, got %v", addrs)
+		server.Stop(StopImmediately)
+		return
+	}
+
+	// the conns of both listeners share the conns of the server.
+	recv := make(chan string, 2)
+	for _, addr := range addrs {
+		client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+			if et == EventRecv {
+				recv <- p.String()
+			}
+		}), &myProtocol{}))
+		go client.DialAndServe(addr.String())
+		defer client.Stop(StopImmediately)
+	}
+	for deadline := time.Now().Add(time.Second); server.ConnCount() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if conns := server.Broadcast(&myPacket{msg: "hello"}); len(conns) != 0 {
+		t.Errorf("broadcast to all conns expected, failed %v", len(conns))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-recv:
+			if msg != "hello" {
+				t.Errorf("hello expected, got %v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Error("broadcast expected to be received by the conns of both listeners")
+		}
+	}
+
+	server.Stop(StopGracefullyAndWait)
+	select {
+	case err := <-serveExit:
+		if err != nil {
+			t.Error("nil expected after stop, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("ServeAll expected to return after stop")
+	}
+	if addrs := server.Addrs(); len(addrs) != 0 {
+		t.Errorf("no addrs expected after stop, got %v", addrs)
+	}
+	for _, addr := range addrs {
+		if _, err := net.Dial("tcp", addr.String()); err == nil {
+			t.Errorf("dial %v expected to fail after stop", addr)
+		}
+	}
+}
+
+func TestServerStopTwice(t *testing.T) {
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}))
+	go server.Serve(l)
+	defer func() {
+		if v := recover(); v != nil {
+			t.Error("stop twice panic : ", v)
+		}
+	}()
+	server.Stop(StopGracefullyAndWait)
+	server.Stop(StopImmediately)
+}
+
+func TestConnStopConcurrently(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	var closed int32
+	connected := make(chan struct{})
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			close(connected)
+		case EventClosed:
+			atomic.AddInt32(&closed, 1)
+		}
+	}), p))
+	done := make(chan struct{})
+	go func() {
+		client.DialAndServe(l.Addr().String())
+		close(done)
+	}()
+	<-connected
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(mode StopMode) {
+			defer wg.Done()
+			client.Stop(mode)
+		}(StopMode(i % 3))
+	}
+	wg.Wait()
+	<-done
+
+	if closed != 1 {
+		t.Errorf("EventClosed expected to be fired once, got %v", closed)
+	}
+}
+
+func TestSendToClosedConn(t *testing.T) {
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), &myProtocol{}).SetSendListLen(0))
+	blocked := make(chan error, 1)
+	go func() {
+		// blocked because nobody takes packets from the send list.
+		blocked <- c.Send(&myPacket{msg: "blocked"})
+	}()
+	if c.IsClosed() {
+		t.Error("conn not expected to be closed before stop")
+	}
+	c.Stop(StopGracefullyButNotWait)
+	if !c.IsClosed() || c.IsStoped() {
+		t.Error("conn expected to be closed but not stopped while stopping gracefully")
+	}
+	if err := <-blocked; err != ErrConnClosed {
+		t.Errorf("'ErrConnClosed' expected for the blocked send, got %v", err)
+	}
+	if err := c.Send(&myPacket{msg: "closed"}); err != ErrConnClosed {
+		t.Errorf("'ErrConnClosed' expected, got %v", err)
+	}
+}
+
+func TestConnDone(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	connected := make(chan struct{})
+	var closed int32
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		switch et {
+		case EventConnected:
+			close(connected)
+		case EventClosed:
+			atomic.StoreInt32(&closed, 1)
+		}
+	}), p))
+	go client.DialAndServe(l.Addr().String())
+	<-connected
+
+	select {
+	case <-client.Done():
+		t.Error("done not expected to be closed before stop")
+	default:
+	}
+	client.Stop(StopImmediately)
+	select {
+	case <-client.Done():
+		if atomic.LoadInt32(&closed) != 1 {
+			t.Error("EventClosed expected before done closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("done expected to be closed after stop")
+	}
+}
+
+func TestSendAndWait(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	connected := make(chan struct{})
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventConnected {
+			close(connected)
+		}
+	}), p))
+	done := make(chan struct{})
+	go func() {
+		client.DialAndServe(l.Addr().String())
+		close(done)
+	}()
+	<-connected
+
+	if err := client.SendAndWait(&myPacket{msg: "wait"}); err != nil {
+		t.Error("send and wait err : ", err)
+	}
+	if client.Stats().PacketsSent != 1 {
+		t.Error("packet expected to be sent after SendAndWait returns")
+	}
+	client.Stop(StopImmediately)
+	<-done
+	if err := client.SendAndWait(&myPacket{msg: "closed"}); err != ErrConnClosed {
+		t.Errorf("'ErrConnClosed' expected, got %v", err)
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	p := &myProtocol{}
+	l, err := net.Listen("tcp", ":")
+	if err != nil {
+		t.Error("listen err : ", err)
+		return
+	}
+	var recvs []string
+	allRecv := make(chan struct{})
+	server := NewServer(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			recvs = append(recvs, p.String())
+			if len(recvs) == 4 {
+				close(allRecv)
+				c.Stop(StopGracefullyButNotWait)
+			}
+		}
+	}), p))
+	go server.Serve(l)
+	defer server.Stop(StopImmediately)
+
+	client := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {}), p))
+	// put packets before serve, so the send loop will see all of them.
+	for i := 0; i < 3; i++ {
+		client.Send(&myPacket{msg: "bulk"})
+	}
+	client.SendPriority(&myPacket{msg: "control"})
+	client.DialAndServe(l.Addr().String())
+	<-allRecv
+
+	if !reflect.DeepEqual(recvs, []string{"control", "bulk", "bulk", "bulk"}) {
+		t.Errorf("priority packet expected to be sent first, got %v", recvs)
+	}
+}
+
+func BenchmarkRecvSmallPackets(b *testing.B) {
+	p := &myProtocol{}
+	done := make(chan struct{})
+	n := 0
+	c := NewConn(NewOpts(funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventRecv {
+			if n++; n == b.N {
+				close(done)
+			}
+		}
+	}), p))
+	server, client := net.Pipe()
+	c.RawConn = server
+	go c.serve(EventAccept)
+	defer c.Stop(StopImmediately)
+
+	// write 100 packets each time, so the recv buf holds many packets each read.
+	pkt, _ := p.Pack(&myPacket{msg: "hello"})
+	batch := bytes.Repeat(pkt, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 100 {
+		if left := b.N - i; left < 100 {
+			client.Write(batch[:left*len(pkt)])
+		} else {
+			client.Write(batch)
+		}
+	}
+	<-done
+}
+
+func BenchmarkWrite(b *testing.B) {
+	h := funcHandler(func(et EventType, c *Conn, p Packet) {})
+	b.Run("PerPacket", func(b *testing.B) {
+		benchmarkWrite(b, NewOpts(h, &myProtocol{}).SetWriteBufLen(0))
+	})
+	b.Run("WriteBatch", func(b *testing.B) {
+		benchmarkWrite(b, NewOpts(h, &myProtocol{}).SetWriteBatch(16))
+	})
+}
+
+func benchmarkWrite(b *testing.B, opts *Options) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal("listen err : ", err)
+	}
+	defer l.Close()
+	go func() {
+		raw, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, raw)
+		raw.Close()
+	}()
+
+	connected := make(chan struct{})
+	h := opts.Handler
+	opts.Handler = funcHandler(func(et EventType, c *Conn, p Packet) {
+		if et == EventConnected {
+			close(connected)
+		}
+		h.OnEvent(et, c, p)
+	})
+	c := NewConn(opts.SetSendListLen(256))
+	go c.DialAndServe(l.Addr().String())
+	<-connected
+	defer c.Stop(StopImmediately)
+
+	p := &myPacket{msg: "hello"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 1; i < b.N; i++ {
+		c.Send(p)
+	}
+	c.SendAndWait(p)
+}
@@ -0,0 +1,60 @@
+package xtcp
+
+import "sync"
+
+// recvWorkerQueueLen is the length of the task queue of each recv worker.
+const recvWorkerQueueLen = 64
+
+// recvPoolsMu guard Options.recvPool and recvWorkerPool.conns of all the options,
+// the options may be copied, eg: by ReconnectConn, so the lock can't be in them.
+var recvPoolsMu sync.Mutex
+
+// recvTask is the EventRecv to dispatch by the recv worker.
+type recvTask struct {
+	c *Conn
+	p Packet
+}
+
+// recvWorkerPool dispatch EventRecv for the conns, each conn is pinned to one worker by its id,
+// so the packets of a conn are handled in order.
+type recvWorkerPool struct {
+	workers []chan recvTask
+	conns   int // the number of conns using the pool, the pool is stopped once it drops to 0.
+}
+
+// newRecvWorkerPool create the pool with n workers.
+func newRecvWorkerPool(n int) *recvWorkerPool {
+	wp := &recvWorkerPool{
+		workers: make([]chan recvTask, n),
+	}
+	for i := range wp.workers {
+		wp.workers[i] = make(chan recvTask, recvWorkerQueueLen)
+	}
+	return wp
+}
+
+func (wp *recvWorkerPool) start() {
+	for _, tasks := range wp.workers {
+		go wp.run(tasks)
+	}
+}
+
+// stop close the task queues, the workers exit after the queued tasks handled.
+func (wp *recvWorkerPool) stop() {
+	for _, tasks := range wp.workers {
+		close(tasks)
+	}
+}
+
+func (wp *recvWorkerPool) run(tasks chan recvTask) {
+	for t := range tasks {
+		t.c.dispatchRecv(t.p)
+		t.c.recvPending.Done()
+	}
+}
+
+// dispatch put the packet to the worker of the conn, blocks if the queue of the worker is full.
+func (wp *recvWorkerPool) dispatch(c *Conn, p Packet) {
+	c.recvPending.Add(1)
+	wp.workers[c.id%uint64(len(wp.workers))] <- recvTask{c: c, p: p}
+}